@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+type aclSubject struct {
+	noun    string
+	any     string
+	actions []klev.Action
+	object  func(string) error
+}
+
+var aclSubjects = map[klev.Subject]aclSubject{
+	klev.SubjectLogs: {
+		noun:    "log",
+		any:     "any log",
+		actions: []klev.Action{klev.ActionList, klev.ActionCreate, klev.ActionGet, klev.ActionUpdate, klev.ActionDelete},
+		object:  aclObject(klev.ParseLogID),
+	},
+	klev.SubjectMessages: {
+		noun:    "messages in log",
+		any:     "messages in any log",
+		actions: []klev.Action{klev.ActionPublish, klev.ActionConsume, klev.ActionCleanup},
+		object:  aclObject(klev.ParseLogID),
+	},
+	klev.SubjectOffsets: {
+		noun:    "offset",
+		any:     "any offset",
+		actions: []klev.Action{klev.ActionList, klev.ActionCreate, klev.ActionGet, klev.ActionUpdate, klev.ActionDelete},
+		object:  aclObject(klev.ParseOffsetID),
+	},
+	klev.SubjectTokens: {
+		noun:    "token",
+		any:     "any token",
+		actions: []klev.Action{klev.ActionList, klev.ActionCreate, klev.ActionGet, klev.ActionUpdate, klev.ActionDelete},
+		object:  aclObject(klev.ParseTokenID),
+	},
+	klev.SubjectIngressWebhooks: {
+		noun:    "ingress webhook",
+		any:     "any ingress webhook",
+		actions: []klev.Action{klev.ActionList, klev.ActionCreate, klev.ActionGet, klev.ActionUpdate, klev.ActionDelete},
+		object:  aclObject(klev.ParseIngressWebhookID),
+	},
+	klev.SubjectEgressWebhooks: {
+		noun:    "egress webhook",
+		any:     "any egress webhook",
+		actions: []klev.Action{klev.ActionList, klev.ActionCreate, klev.ActionGet, klev.ActionUpdate, klev.ActionDelete, klev.ActionRotate, klev.ActionStatus},
+		object:  aclObject(klev.ParseEgressWebhookID),
+	},
+	klev.SubjectFilters: {
+		noun:    "filter",
+		any:     "any filter",
+		actions: []klev.Action{klev.ActionList, klev.ActionCreate, klev.ActionGet, klev.ActionUpdate, klev.ActionDelete, klev.ActionStatus},
+		object:  aclObject(klev.ParseFilterID),
+	},
+}
+
+func aclObject[T any](parse func(string) (T, error)) func(string) error {
+	return func(s string) error {
+		_, err := parse(s)
+		return err
+	}
+}
+
+// aclActionHasObject reports if an action is applied to a specific object,
+// e.g. a list or a create can't be restricted to an id
+func aclActionHasObject(action klev.Action) bool {
+	return action != klev.ActionList && action != klev.ActionCreate
+}
+
+// ACLItemOut is an acl item, together with a plain words description
+type ACLItemOut struct {
+	Item        klev.ACLItem `json:"item"`
+	Description string       `json:"description"`
+}
+
+// parseACL parses raw json acl items (as used by '--acl') and
+// 'subject:action:object' items (as used by '--allow'), validating each one
+func parseACL(raw []string, allow []string) ([]klev.ACLItem, error) {
+	var items []klev.ACLItem
+	for _, l := range raw {
+		var item klev.ACLItem
+		if err := json.Unmarshal([]byte(l), &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	for _, l := range allow {
+		var item klev.ACLItem
+		if err := item.UnmarshalText([]byte(l)); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	for _, item := range items {
+		if err := validateACLItem(item); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func validateACLItem(item klev.ACLItem) error {
+	if item.Subject == klev.NilSubject {
+		return errACLSubjectMissing()
+	}
+	subject, ok := aclSubjects[item.Subject]
+	if !ok {
+		return klev.ErrACLSubjectInvalid(item.Subject.String(), joinSubjects(klev.AllSubjects))
+	}
+
+	if item.Action == klev.NilAction {
+		if item.Object != "" {
+			return errACLActionMissing(item)
+		}
+		return nil
+	}
+	if !containsAction(subject.actions, item.Action) {
+		return errACLSubjectActionInvalid(item, subject.actions)
+	}
+
+	if item.Object == "" {
+		return nil
+	}
+	if !aclActionHasObject(item.Action) {
+		return errACLActionInvalidObject(item)
+	}
+	if err := subject.object(item.Object); err != nil {
+		return errACLObjectInvalid(item, err)
+	}
+	return nil
+}
+
+func describeACL(items []klev.ACLItem) []ACLItemOut {
+	var out = make([]ACLItemOut, len(items))
+	for i, item := range items {
+		out[i] = ACLItemOut{Item: item, Description: describeACLItem(item)}
+	}
+	return out
+}
+
+func describeACLItem(item klev.ACLItem) string {
+	subject, ok := aclSubjects[item.Subject]
+	switch {
+	case !ok:
+		return fmt.Sprintf("unknown subject %s", item.Subject)
+	case item.Action == klev.NilAction:
+		return fmt.Sprintf("all actions on %s", strings.ReplaceAll(item.Subject.String(), "_", " "))
+	case item.Object == "" && item.Action == klev.ActionCreate:
+		return fmt.Sprintf("create %s", subject.noun)
+	case item.Object == "" && item.Action == klev.ActionList:
+		return fmt.Sprintf("list %s", strings.ReplaceAll(item.Subject.String(), "_", " "))
+	case item.Object == "":
+		return fmt.Sprintf("%s %s", item.Action, subject.any)
+	default:
+		return fmt.Sprintf("%s %s %s", item.Action, subject.noun, item.Object)
+	}
+}
+
+func containsAction(actions []klev.Action, action klev.Action) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func joinSubjects(subjects []klev.Subject) string {
+	var parts = make([]string, len(subjects))
+	for i, s := range subjects {
+		parts[i] = s.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func joinActions(actions []klev.Action) string {
+	var parts = make([]string, len(actions))
+	for i, a := range actions {
+		parts[i] = a.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func errACLSubjectMissing() error {
+	return &klev.APIError{
+		Code:    klev.ErrACLSubjectMissingCode,
+		Message: "ACL subject is missing",
+	}
+}
+
+func errACLActionMissing(item klev.ACLItem) error {
+	return &klev.APIError{
+		Code:    klev.ErrACLActionMissingCode,
+		Message: fmt.Sprintf("'%s' has an object, but is missing an action", item.Subject),
+	}
+}
+
+func errACLSubjectActionInvalid(item klev.ACLItem, valid []klev.Action) error {
+	return &klev.APIError{
+		Code:    klev.ErrACLSubjectActionInvalidCode,
+		Message: fmt.Sprintf("'%s' is not a valid action for '%s'. Must be one of '%s'", item.Action, item.Subject, joinActions(valid)),
+	}
+}
+
+func errACLActionInvalidObject(item klev.ACLItem) error {
+	return &klev.APIError{
+		Code:    klev.ErrACLActionInvalidObjectCode,
+		Message: fmt.Sprintf("'%s:%s' cannot be restricted to object '%s'", item.Subject, item.Action, item.Object),
+	}
+}
+
+func errACLObjectInvalid(item klev.ACLItem, err error) error {
+	var code string
+	switch item.Subject {
+	case klev.SubjectLogs, klev.SubjectMessages:
+		code = klev.ErrACLObjectLogInvalidCode
+	case klev.SubjectOffsets:
+		code = klev.ErrACLObjectOffsetInvalidCode
+	case klev.SubjectTokens:
+		code = klev.ErrACLObjectTokenInvalidCode
+	case klev.SubjectIngressWebhooks:
+		code = klev.ErrACLObjectIngressWebhookInvalidCode
+	case klev.SubjectEgressWebhooks:
+		code = klev.ErrACLObjectEgressWebhookInvalidCode
+	case klev.SubjectFilters:
+		code = klev.ErrACLObjectFilterInvalidCode
+	}
+	return &klev.APIError{
+		Code:    code,
+		Message: fmt.Sprintf("'%s' is not a valid object for '%s:%s': %v", item.Object, item.Subject, item.Action, err),
+	}
+}
+
+// aclRole expands a role preset into the acl items it requires
+func aclRole(role string, logID string, offsetID string) ([]klev.ACLItem, error) {
+	switch role {
+	case "producer":
+		if logID == "" {
+			return nil, fmt.Errorf("role '%s' requires log-id", role)
+		}
+		log, err := klev.ParseLogID(logID)
+		if err != nil {
+			return nil, err
+		}
+		return []klev.ACLItem{
+			klev.ACLObject(klev.SubjectLogs, klev.ActionGet, log),
+			klev.ACLObject(klev.SubjectMessages, klev.ActionPublish, log),
+		}, nil
+	case "consumer":
+		if logID == "" {
+			return nil, fmt.Errorf("role '%s' requires log-id", role)
+		}
+		log, err := klev.ParseLogID(logID)
+		if err != nil {
+			return nil, err
+		}
+		items := []klev.ACLItem{
+			klev.ACLObject(klev.SubjectLogs, klev.ActionGet, log),
+			klev.ACLObject(klev.SubjectMessages, klev.ActionConsume, log),
+		}
+		if offsetID != "" {
+			offset, err := klev.ParseOffsetID(offsetID)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items,
+				klev.ACLObject(klev.SubjectOffsets, klev.ActionGet, offset),
+				klev.ACLObject(klev.SubjectOffsets, klev.ActionUpdate, offset),
+			)
+		}
+		return items, nil
+	case "webhook-admin":
+		return []klev.ACLItem{
+			klev.ACLAction(klev.SubjectLogs, klev.ActionList),
+			klev.ACLSubject(klev.SubjectIngressWebhooks),
+			klev.ACLSubject(klev.SubjectEgressWebhooks),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown role '%s'. Must be one of 'producer, consumer, webhook-admin'", role)
+	}
+}
+
+type aclCommand struct {
+	command string
+	subject klev.Subject
+	action  klev.Action
+}
+
+// aclCommands lists the cli commands, together with the permission each requires
+var aclCommands = []aclCommand{
+	{"paths", klev.NilSubject, klev.NilAction},
+	{"publish", klev.SubjectMessages, klev.ActionPublish},
+	{"consume", klev.SubjectMessages, klev.ActionConsume},
+	{"get-by-offset", klev.SubjectMessages, klev.ActionConsume},
+	{"cleanup", klev.SubjectMessages, klev.ActionCleanup},
+	{"logs list", klev.SubjectLogs, klev.ActionList},
+	{"logs create", klev.SubjectLogs, klev.ActionCreate},
+	{"logs get", klev.SubjectLogs, klev.ActionGet},
+	{"logs stats", klev.SubjectLogs, klev.ActionGet},
+	{"logs update", klev.SubjectLogs, klev.ActionUpdate},
+	{"logs delete", klev.SubjectLogs, klev.ActionDelete},
+	{"offsets list", klev.SubjectOffsets, klev.ActionList},
+	{"offsets create", klev.SubjectOffsets, klev.ActionCreate},
+	{"offsets get", klev.SubjectOffsets, klev.ActionGet},
+	{"offsets update", klev.SubjectOffsets, klev.ActionUpdate},
+	{"offsets delete", klev.SubjectOffsets, klev.ActionDelete},
+	{"tokens list", klev.SubjectTokens, klev.ActionList},
+	{"tokens create", klev.SubjectTokens, klev.ActionCreate},
+	{"tokens get", klev.SubjectTokens, klev.ActionGet},
+	{"tokens update", klev.SubjectTokens, klev.ActionUpdate},
+	{"tokens delete", klev.SubjectTokens, klev.ActionDelete},
+	{"ingress-webhooks list", klev.SubjectIngressWebhooks, klev.ActionList},
+	{"ingress-webhooks create", klev.SubjectIngressWebhooks, klev.ActionCreate},
+	{"ingress-webhooks get", klev.SubjectIngressWebhooks, klev.ActionGet},
+	{"ingress-webhooks update", klev.SubjectIngressWebhooks, klev.ActionUpdate},
+	{"ingress-webhooks delete", klev.SubjectIngressWebhooks, klev.ActionDelete},
+	{"egress-webhooks list", klev.SubjectEgressWebhooks, klev.ActionList},
+	{"egress-webhooks create", klev.SubjectEgressWebhooks, klev.ActionCreate},
+	{"egress-webhooks get", klev.SubjectEgressWebhooks, klev.ActionGet},
+	{"egress-webhooks rotate", klev.SubjectEgressWebhooks, klev.ActionRotate},
+	{"egress-webhooks status", klev.SubjectEgressWebhooks, klev.ActionStatus},
+	{"egress-webhooks update", klev.SubjectEgressWebhooks, klev.ActionUpdate},
+	{"egress-webhooks delete", klev.SubjectEgressWebhooks, klev.ActionDelete},
+	{"filters list", klev.SubjectFilters, klev.ActionList},
+	{"filters create", klev.SubjectFilters, klev.ActionCreate},
+	{"filters get", klev.SubjectFilters, klev.ActionGet},
+	{"filters status", klev.SubjectFilters, klev.ActionStatus},
+	{"filters update", klev.SubjectFilters, klev.ActionUpdate},
+	{"filters delete", klev.SubjectFilters, klev.ActionDelete},
+}
+
+const (
+	aclAccessAll  = "all"
+	aclAccessSome = "some"
+	aclAccessNone = "none"
+	// aclAccessUnknown is used when the acl is not available
+	aclAccessUnknown = "unknown"
+)
+
+// ACLCommandOut describes if a cli command can be run with a given acl
+type ACLCommandOut struct {
+	Command     string   `json:"command"`
+	Access      string   `json:"access"`
+	Objects     []string `json:"objects,omitempty"`
+	Description string   `json:"description"`
+}
+
+// explainACL checks every known cli command against the acl items
+func explainACL(items []klev.ACLItem) []ACLCommandOut {
+	var out = make([]ACLCommandOut, len(aclCommands))
+	for i, c := range aclCommands {
+		out[i] = explainACLCommand(c, items)
+	}
+	return out
+}
+
+func explainACLCommand(c aclCommand, items []klev.ACLItem) ACLCommandOut {
+	out := ACLCommandOut{Command: c.command, Access: aclAccessNone}
+
+	if c.subject == klev.NilSubject {
+		out.Access = aclAccessAll
+		out.Description = fmt.Sprintf("can run 'klev %s'", c.command)
+		return out
+	}
+
+	for _, item := range items {
+		if item.Subject != c.subject {
+			continue
+		}
+		if item.Action != klev.NilAction && item.Action != c.action {
+			continue
+		}
+		if item.Action == klev.NilAction || item.Object == "" {
+			out.Access = aclAccessAll
+			out.Objects = nil
+			break
+		}
+		out.Access = aclAccessSome
+		out.Objects = append(out.Objects, item.Object)
+	}
+
+	subject := aclSubjects[c.subject]
+	switch out.Access {
+	case aclAccessAll:
+		if aclActionHasObject(c.action) {
+			out.Description = fmt.Sprintf("can run 'klev %s' for %s", c.command, subject.any)
+		} else {
+			out.Description = fmt.Sprintf("can run 'klev %s'", c.command)
+		}
+	case aclAccessSome:
+		out.Description = fmt.Sprintf("can run 'klev %s' only for %s %s", c.command, subject.noun, strings.Join(out.Objects, ", "))
+	default:
+		out.Description = fmt.Sprintf("cannot run 'klev %s'", c.command)
+	}
+	return out
+}
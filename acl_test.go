@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func TestParseACL(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   []string
+		allow []string
+		items []klev.ACLItem
+		code  string
+	}{
+		{
+			name:  "subject",
+			allow: []string{"logs"},
+			items: []klev.ACLItem{{Subject: klev.SubjectLogs}},
+		},
+		{
+			name:  "action",
+			allow: []string{"messages:publish"},
+			items: []klev.ACLItem{{Subject: klev.SubjectMessages, Action: klev.ActionPublish}},
+		},
+		{
+			name:  "object",
+			allow: []string{"messages:consume:log_2IKrqtEBeYobBAM2gkuFNB6pBFL"},
+			items: []klev.ACLItem{{Subject: klev.SubjectMessages, Action: klev.ActionConsume, Object: "log_2IKrqtEBeYobBAM2gkuFNB6pBFL"}},
+		},
+		{
+			name:  "raw and allow",
+			raw:   []string{`"offsets:get"`},
+			allow: []string{"filters:status"},
+			items: []klev.ACLItem{{Subject: klev.SubjectOffsets, Action: klev.ActionGet}, {Subject: klev.SubjectFilters, Action: klev.ActionStatus}},
+		},
+		{
+			name:  "unknown subject",
+			allow: []string{"queues:get"},
+			code:  klev.ErrACLSubjectInvalidCode,
+		},
+		{
+			name:  "unknown action",
+			allow: []string{"logs:read"},
+			code:  klev.ErrACLActionInvalidCode,
+		},
+		{
+			name:  "action of another subject",
+			allow: []string{"logs:publish"},
+			code:  klev.ErrACLSubjectActionInvalidCode,
+		},
+		{
+			name:  "empty object",
+			allow: []string{"logs:get:"},
+			code:  klev.ErrACLObjectMissingCode,
+		},
+		{
+			name:  "object on list",
+			allow: []string{"logs:list:log_2IKrqtEBeYobBAM2gkuFNB6pBFL"},
+			code:  klev.ErrACLActionInvalidObjectCode,
+		},
+		{
+			name:  "object of another subject",
+			allow: []string{"logs:get:off_2IKrqtEBeYobBAM2gkuFNB6pBFL"},
+			code:  klev.ErrACLObjectLogInvalidCode,
+		},
+		{
+			name: "raw unknown action",
+			raw:  []string{`"tokens:publish"`},
+			code: klev.ErrACLSubjectActionInvalidCode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := parseACL(tt.raw, tt.allow)
+			if tt.code != "" {
+				if !klev.IsError(err, tt.code) {
+					t.Fatalf("expected %s error, got %v", tt.code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(items) != len(tt.items) {
+				t.Fatalf("expected %v, got %v", tt.items, items)
+			}
+			for i := range items {
+				if items[i] != tt.items[i] {
+					t.Fatalf("expected %v, got %v", tt.items, items)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateACLItem(t *testing.T) {
+	tests := []struct {
+		name string
+		item klev.ACLItem
+		code string
+	}{
+		{"subject", klev.ACLItem{Subject: klev.SubjectTokens}, ""},
+		{"missing subject", klev.ACLItem{Action: klev.ActionGet}, klev.ErrACLSubjectMissingCode},
+		{"missing action", klev.ACLItem{Subject: klev.SubjectLogs, Object: "log_2IKrqtEBeYobBAM2gkuFNB6pBFL"}, klev.ErrACLActionMissingCode},
+		{"rotate egress webhook", klev.ACLItem{Subject: klev.SubjectEgressWebhooks, Action: klev.ActionRotate}, ""},
+		{"rotate filter", klev.ACLItem{Subject: klev.SubjectFilters, Action: klev.ActionRotate}, klev.ErrACLSubjectActionInvalidCode},
+		{"object on create", klev.ACLItem{Subject: klev.SubjectTokens, Action: klev.ActionCreate, Object: "tok_2IKrqtEBeYobBAM2gkuFNB6pBFL"}, klev.ErrACLActionInvalidObjectCode},
+		{"malformed object", klev.ACLItem{Subject: klev.SubjectOffsets, Action: klev.ActionUpdate, Object: "off_"}, klev.ErrACLObjectOffsetInvalidCode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateACLItem(tt.item)
+			switch {
+			case tt.code == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.code != "" && !klev.IsError(err, tt.code):
+				t.Fatalf("expected %s error, got %v", tt.code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+const (
+	keyringService = "klev"
+	keyringUser    = "authtoken"
+)
+
+var errAuthtokenMissing = errors.New("authtoken is missing. pass with '--authtoken', '--authtoken-file', '--authtoken-cmd', via KLEV_TOKEN env variable or store it with 'klev login'. get it from https://dash.klev.dev")
+
+// LoginOut describes where the token was stored
+type LoginOut struct {
+	Storage string `json:"storage"`
+	Path    string `json:"path,omitempty"`
+}
+
+func login() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "login",
+		Short: "store an authtoken in the os keyring or an encrypted file",
+		Args:  cobra.NoArgs,
+		// login is how the token gets stored, so don't require it
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			resolveBaseURL(cmd)
+			return nil
+		},
+	}
+
+	file := cmd.Flags().Bool("file", false, "store in an encrypted file, even if keyring is available")
+	path := cmd.Flags().String("path", "", "path of the encrypted file (defaults to the user config dir)")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		token, _, err := givenToken(cmd)
+		if err != nil {
+			return err
+		}
+		if token == "" {
+			if token, err = readSecret("authtoken: "); err != nil {
+				return err
+			}
+		}
+		if token == "" {
+			return errAuthtokenMissing
+		}
+
+		if _, err := newKlient(token).Paths.Get(cmd.Context()); err != nil {
+			return outputErr(err)
+		}
+
+		if !*file {
+			if err := keyring.Set(keyringService, keyringUser, token); err == nil {
+				return outputValue(LoginOut{Storage: "keyring"})
+			} else {
+				fmt.Fprintf(os.Stderr, "keyring not available (%v), using encrypted file\n", err)
+			}
+		}
+
+		if *path == "" {
+			if *path, err = loginFilePath(); err != nil {
+				return err
+			}
+		}
+
+		passphrase, err := newPassphrase()
+		if err != nil {
+			return err
+		}
+		if err := writeEncryptedToken(*path, token, passphrase); err != nil {
+			return err
+		}
+		return outputValue(LoginOut{Storage: "file", Path: *path})
+	}
+
+	return cmd
+}
+
+func logout() *cobra.Command {
+	return &cobra.Command{
+		Use:   "logout",
+		Short: "remove the authtoken stored by login",
+		Args:  cobra.NoArgs,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var out []LoginOut
+			keyringErr := keyring.Delete(keyringService, keyringUser)
+			if keyringErr == nil {
+				out = append(out, LoginOut{Storage: "keyring"})
+			}
+
+			// the file is removed even when the keyring is not available
+			path, err := loginFilePath()
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(path); err == nil {
+				out = append(out, LoginOut{Storage: "file", Path: path})
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+
+			if keyringErr != nil && !errors.Is(keyringErr, keyring.ErrNotFound) {
+				if len(out) > 0 {
+					outputValue(out)
+				}
+				return fmt.Errorf("could not remove authtoken from keyring: %w", keyringErr)
+			}
+			return outputValue(out)
+		},
+	}
+}
+
+// loadLogin finds a token stored by login, first in the keyring then in the encrypted file
+func loadLogin() (string, string, error) {
+	token, keyringErr := keyring.Get(keyringService, keyringUser)
+	switch {
+	case keyringErr == nil:
+		return token, "keyring", nil
+	case errors.Is(keyringErr, keyring.ErrNotFound):
+		keyringErr = nil
+	}
+
+	path, err := loginFilePath()
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if keyringErr != nil {
+			return "", "", fmt.Errorf("%w (keyring not available: %v)", errAuthtokenMissing, keyringErr)
+		}
+		return "", "", errAuthtokenMissing
+	}
+	if keyringErr != nil {
+		// like login, which stores the token in the file when the keyring is not available
+		fmt.Fprintf(os.Stderr, "keyring not available (%v), using encrypted file\n", keyringErr)
+	}
+
+	passphrase := os.Getenv("KLEV_PASSPHRASE")
+	if passphrase == "" {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			// stdin is left for the command, like a piped publish
+			return "", "", fmt.Errorf("authtoken is in the encrypted file %s. set KLEV_PASSPHRASE to decrypt it without a terminal", path)
+		}
+		if passphrase, err = readSecret("passphrase: "); err != nil {
+			return "", "", err
+		}
+	}
+
+	token, err = readEncryptedToken(path, passphrase)
+	if err != nil {
+		return "", "", err
+	}
+	return token, "encrypted-file", nil
+}
+
+func loginFilePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "klev", "authtoken.age"), nil
+}
+
+func writeEncryptedToken(path string, token string, passphrase string) error {
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, token); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+func readEncryptedToken(path string, passphrase string) (string, error) {
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r, err := age.Decrypt(f, identity)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt %s: %w", path, err)
+	}
+	token, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+func readTokenFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if token := strings.TrimSpace(string(b)); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("authtoken file %s is empty", path)
+}
+
+// runTokenCmd runs a credential helper (like 'pass show klev') through the shell
+// and uses the first line of its output as the token
+func runTokenCmd(ctx context.Context, command string) (string, error) {
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		c = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	// stdin is left for the command being run, like a piped publish
+	c.Stderr = os.Stderr
+
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("authtoken command failed: %w", err)
+	}
+
+	line, _, _ := strings.Cut(string(out), "\n")
+	if token := strings.TrimSpace(line); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("authtoken command returned no token")
+}
+
+// readSecret reads a line from the terminal without echo, or from stdin when it is not a terminal
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := stdin.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func newPassphrase() (string, error) {
+	if passphrase := os.Getenv("KLEV_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	passphrase, err := readSecret("passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase is required to encrypt the token")
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		repeat, err := readSecret("repeat passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if repeat != passphrase {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func benchRoot() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "benchmark publishing and consuming",
+	}
+
+	cmd.AddCommand(benchProduce())
+	cmd.AddCommand(benchConsume())
+
+	return cmd
+}
+
+// BenchOut is the result of a benchmark run
+type BenchOut struct {
+	Operation      string       `json:"operation"`
+	Duration       float64      `json:"duration_sec"`
+	Requests       int64        `json:"requests"`
+	Messages       int64        `json:"messages"`
+	Bytes          int64        `json:"bytes"`
+	Errors         int64        `json:"errors"`
+	MessagesPerSec float64      `json:"messages_per_sec"`
+	BytesPerSec    float64      `json:"bytes_per_sec"`
+	Latency        BenchLatency `json:"latency_ms"`
+	LastError      string       `json:"last_error,omitempty"`
+}
+
+// BenchLatency are request latency percentiles, in milliseconds
+type BenchLatency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// benchStats is collected by each worker, and merged at the end
+type benchStats struct {
+	requests  int64
+	messages  int64
+	bytes     int64
+	errors    int64
+	lastError error
+	latencies []time.Duration
+}
+
+func (s *benchStats) merge(o benchStats) {
+	s.requests += o.requests
+	s.messages += o.messages
+	s.bytes += o.bytes
+	s.errors += o.errors
+	if o.lastError != nil {
+		s.lastError = o.lastError
+	}
+	s.latencies = append(s.latencies, o.latencies...)
+}
+
+func (s *benchStats) out(operation string, elapsed time.Duration) BenchOut {
+	out := BenchOut{
+		Operation:      operation,
+		Duration:       elapsed.Seconds(),
+		Requests:       s.requests,
+		Messages:       s.messages,
+		Bytes:          s.bytes,
+		Errors:         s.errors,
+		MessagesPerSec: float64(s.messages) / elapsed.Seconds(),
+		BytesPerSec:    float64(s.bytes) / elapsed.Seconds(),
+	}
+	if s.lastError != nil {
+		out.LastError = s.lastError.Error()
+	}
+
+	out.Latency = latencyPercentiles(s.latencies)
+	return out
+}
+
+// latencyPercentiles sorts the latencies in place and summarizes them
+func latencyPercentiles(latencies []time.Duration) BenchLatency {
+	if len(latencies) == 0 {
+		return BenchLatency{}
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) float64 {
+		idx := int(p * float64(len(latencies)-1))
+		return float64(latencies[idx]) / float64(time.Millisecond)
+	}
+	return BenchLatency{
+		P50: percentile(0.50),
+		P95: percentile(0.95),
+		P99: percentile(0.99),
+		Max: percentile(1),
+	}
+}
+
+// validateBench checks the flags shared by benchmarks, before any worker starts
+func validateBench(concurrency int, rate int) error {
+	switch {
+	case concurrency < 1:
+		return fmt.Errorf("concurrency must be at least 1")
+	case rate < 0 || rate > int(time.Second):
+		return fmt.Errorf("rate must be between 0 (unlimited) and %d", int(time.Second))
+	}
+	return nil
+}
+
+// runBench runs fn from concurrent workers until the context is done,
+// limiting the total calls to rate per second (when positive)
+func runBench(ctx context.Context, concurrency int, rate int, fn func(ctx context.Context, worker int, stats *benchStats)) benchStats {
+	var tokens <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var total benchStats
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			var stats benchStats
+			for {
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-ctx.Done():
+					}
+				}
+				if ctx.Err() != nil {
+					break
+				}
+				fn(ctx, worker, &stats)
+			}
+
+			mu.Lock()
+			total.merge(stats)
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	return total
+}
+
+func benchProduce() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "produce <log-id>",
+		Short: "benchmark publishing messages",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	concurrency := cmd.Flags().Int("concurrency", 1, "number of concurrent publishers")
+	rate := cmd.Flags().Int("rate", 0, "target messages per second across all publishers, 0 for unlimited")
+	duration := cmd.Flags().Duration("duration", 10*time.Second, "how long to run")
+	keySize := cmd.Flags().Int("key-size", 16, "size of the synthetic key")
+	valueSize := cmd.Flags().Int("value-size", 256, "size of the synthetic value")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if err := validateBench(*concurrency, *rate); err != nil {
+			return err
+		}
+		if *keySize < 0 || *valueSize < 0 {
+			return fmt.Errorf("key-size and value-size can't be negative")
+		}
+		id, err := klev.ParseLogID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), *duration)
+		defer cancel()
+
+		start := time.Now()
+		stats := runBench(ctx, *concurrency, *rate, func(ctx context.Context, worker int, stats *benchStats) {
+			key, value := benchData(*keySize), benchData(*valueSize)
+
+			reqStart := time.Now()
+			_, err := klient.Messages.Post(ctx, id, time.Time{}, key, value)
+			if ctx.Err() != nil {
+				// interrupted by the end of the run
+				return
+			}
+
+			stats.requests++
+			stats.latencies = append(stats.latencies, time.Since(reqStart))
+			if err != nil {
+				stats.errors++
+				stats.lastError = err
+				return
+			}
+			stats.messages++
+			stats.bytes += int64(len(key) + len(value))
+		})
+
+		return outputValue(stats.out("produce", time.Since(start)))
+	}
+
+	return cmd
+}
+
+func benchConsume() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "consume <log-id>",
+		Short: "benchmark consuming messages",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	concurrency := cmd.Flags().Int("concurrency", 1, "number of concurrent consumers, each reading the log independently")
+	rate := cmd.Flags().Int("rate", 0, "target requests per second across all consumers, 0 for unlimited")
+	duration := cmd.Flags().Duration("duration", 10*time.Second, "how long to run")
+	offset := cmd.Flags().Int64("offset", klev.OffsetOldest, "the starting offset")
+	size := cmd.Flags().Int32("size", 100, "max messages to consume per request")
+	poll := cmd.Flags().Duration("poll", time.Second, "how long to wait for new messages")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if err := validateBench(*concurrency, *rate); err != nil {
+			return err
+		}
+		id, err := klev.ParseLogID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), *duration)
+		defer cancel()
+
+		var offsets = make([]int64, *concurrency)
+		for i := range offsets {
+			offsets[i] = *offset
+		}
+
+		start := time.Now()
+		stats := runBench(ctx, *concurrency, *rate, func(ctx context.Context, worker int, stats *benchStats) {
+			reqStart := time.Now()
+			next, msgs, err := klient.Messages.Consume(ctx, id, klev.ConsumeOffset(offsets[worker]), klev.ConsumeLen(*size), klev.ConsumePoll(*poll))
+			if ctx.Err() != nil {
+				return
+			}
+
+			stats.requests++
+			stats.latencies = append(stats.latencies, time.Since(reqStart))
+			if err != nil {
+				stats.errors++
+				stats.lastError = err
+				return
+			}
+			offsets[worker] = next
+			stats.messages += int64(len(msgs))
+			for _, m := range msgs {
+				stats.bytes += int64(len(m.Key) + len(m.Value))
+			}
+		})
+
+		return outputValue(stats.out("consume", time.Since(start)))
+	}
+
+	return cmd
+}
+
+const benchAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func benchData(size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = benchAlphabet[rand.Intn(len(benchAlphabet))]
+	}
+	return b
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func bridgeRoot() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bridge",
+		Short: "move messages between logs and other messaging systems",
+	}
+
+	cmd.AddCommand(bridgeKafka())
+	cmd.AddCommand(bridgeMQTT())
+
+	return cmd
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func bridgeKafka() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "kafka",
+		Short: "copy records between a kafka topic and a log, until interrupted",
+		Args:  cobra.NoArgs,
+	}
+
+	brokers := cmd.Flags().StringSlice("brokers", nil, "kafka bootstrap brokers, like localhost:9092")
+	topic := cmd.Flags().String("topic", "", "kafka topic")
+	logID := cmd.Flags().String("log-id", "", "log id")
+	direction := cmd.Flags().String("direction", "kafka-to-klev", "direction: kafka-to-klev or klev-to-kafka")
+	group := cmd.Flags().String("group", "klev-bridge", "kafka consumer group, committing consumed offsets (kafka-to-klev)")
+	start := cmd.Flags().String("start", "oldest", "where a new consumer group starts, oldest or newest (kafka-to-klev)")
+	offsetID := cmd.Flags().String("offset-id", "", "offset to checkpoint the next offset to produce in, required for klev-to-kafka")
+	offset := cmd.Flags().Int64("offset", klev.OffsetOldest, "the starting offset, when the offset is not set (klev-to-kafka)")
+	size := cmd.Flags().Int32("size", 100, "max messages to copy at once")
+	poll := cmd.Flags().Duration("poll", 10*time.Second, "how long to wait for new messages (klev-to-kafka)")
+	useTLS := cmd.Flags().Bool("tls", false, "connect to brokers with tls")
+	saslMechanism := cmd.Flags().String("sasl-mechanism", "", "sasl mechanism: plain, scram-sha-256 or scram-sha-512")
+	saslUser := cmd.Flags().String("sasl-user", "", "sasl user")
+	saslPassword := cmd.Flags().String("sasl-password", "", "sasl password")
+
+	cmd.MarkFlagRequired("brokers")
+	cmd.MarkFlagRequired("topic")
+	cmd.MarkFlagRequired("log-id")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseLogID(*logID)
+		if err != nil {
+			return outputErr(err)
+		}
+
+		opts := []kgo.Opt{kgo.SeedBrokers(*brokers...)}
+		if *useTLS {
+			opts = append(opts, kgo.DialTLSConfig(&tls.Config{}))
+		}
+		switch *saslMechanism {
+		case "":
+		case "plain":
+			opts = append(opts, kgo.SASL(plain.Auth{User: *saslUser, Pass: *saslPassword}.AsMechanism()))
+		case "scram-sha-256":
+			opts = append(opts, kgo.SASL(scram.Auth{User: *saslUser, Pass: *saslPassword}.AsSha256Mechanism()))
+		case "scram-sha-512":
+			opts = append(opts, kgo.SASL(scram.Auth{User: *saslUser, Pass: *saslPassword}.AsSha512Mechanism()))
+		default:
+			return fmt.Errorf("unknown sasl mechanism '%s'. Must be one of 'plain, scram-sha-256, scram-sha-512'", *saslMechanism)
+		}
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		switch *direction {
+		case "kafka-to-klev":
+			var reset kgo.Offset
+			switch *start {
+			case "oldest":
+				reset = kgo.NewOffset().AtStart()
+			case "newest":
+				reset = kgo.NewOffset().AtEnd()
+			default:
+				return fmt.Errorf("unknown start '%s'. Must be one of 'oldest, newest'", *start)
+			}
+			opts = append(opts,
+				kgo.ConsumerGroup(*group),
+				kgo.ConsumeTopics(*topic),
+				kgo.ConsumeResetOffset(reset),
+				kgo.DisableAutoCommit(),
+				// partitions are not revoked between publishing records and committing them
+				kgo.BlockRebalanceOnPoll(),
+			)
+			client, err := kgo.NewClient(opts...)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			return kafkaToKlev(ctx, client, id, int(*size))
+		case "klev-to-kafka":
+			if *offsetID == "" {
+				return fmt.Errorf("'--offset-id' is required for klev-to-kafka")
+			}
+			oid, err := klev.ParseOffsetID(*offsetID)
+			if err != nil {
+				return outputErr(err)
+			}
+
+			opts = append(opts, kgo.DefaultProduceTopic(*topic))
+			client, err := kgo.NewClient(opts...)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+
+			return klevToKafka(ctx, client, id, oid, *offset, *size, *poll)
+		default:
+			return fmt.Errorf("unknown direction '%s'. Must be one of 'kafka-to-klev, klev-to-kafka'", *direction)
+		}
+	}
+
+	return cmd
+}
+
+// kafkaToKlev publishes polled records, keeping their key, value and timestamp,
+// then commits them to the consumer group
+func kafkaToKlev(ctx context.Context, client *kgo.Client, id klev.LogID, size int) error {
+	for {
+		fetches := client.PollRecords(ctx, size)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var fetchErr error
+		fetches.EachError(func(topic string, partition int32, err error) {
+			// the client keeps retrying other errors, like a broker being unavailable
+			var kafkaErr *kerr.Error
+			if (errors.As(err, &kafkaErr) && !kafkaErr.Retriable) || errors.Is(err, kgo.ErrClientClosed) {
+				fetchErr = fmt.Errorf("fetch %s/%d failed: %w", topic, partition, err)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "fetch %s/%d failed: %v\n", topic, partition, err)
+		})
+		if fetchErr != nil {
+			return outputErr(fetchErr)
+		}
+
+		records := fetches.Records()
+		if len(records) == 0 {
+			client.AllowRebalance()
+			continue
+		}
+
+		msgs := make([]klev.PublishMessage, len(records))
+		for i, r := range records {
+			msgs[i] = klev.PublishMessage{Time: r.Timestamp, Key: r.Key, Value: r.Value}
+		}
+
+		var next int64
+		err := retryIf(ctx, klevRetriable, func() error {
+			// the publish and commit shouldn't be interrupted half way
+			var err error
+			next, err = klient.Messages.Publish(context.Background(), id, msgs)
+			return err
+		})
+		switch {
+		case ctx.Err() != nil:
+			// not committed, the records are consumed again
+			return nil
+		case err != nil:
+			return outputErr(err)
+		}
+
+		if err := client.CommitRecords(context.Background(), records...); err != nil {
+			return outputErr(err)
+		}
+		client.AllowRebalance()
+
+		outputValue(SourceOut{LogID: id, Messages: int64(len(msgs)), NextOffset: next})
+	}
+}
+
+// klevToKafka produces consumed messages, keeping their key, value and time,
+// then checkpoints the next offset to produce
+func klevToKafka(ctx context.Context, client *kgo.Client, id klev.LogID, offsetID klev.OffsetID, offset int64, size int32, poll time.Duration) error {
+	o, err := klient.Offsets.Get(ctx, offsetID)
+	if err != nil {
+		return outputErr(err)
+	}
+	if o.LogID != id {
+		return fmt.Errorf("offset %s is for log %s", o.OffsetID, o.LogID)
+	}
+	if o.Value >= 0 {
+		offset = o.Value
+	}
+
+	_, err = sinkConsume(ctx, id, offset, size, true, poll, func(msgs []klev.ConsumeMessage, next int64) error {
+		if len(msgs) == 0 {
+			return nil
+		}
+
+		records := make([]*kgo.Record, len(msgs))
+		for i, m := range msgs {
+			records[i] = &kgo.Record{Key: m.Key, Value: m.Value, Timestamp: m.Time}
+		}
+		// the produce and checkpoint shouldn't be interrupted half way
+		if err := client.ProduceSync(context.Background(), records...).FirstErr(); err != nil {
+			return err
+		}
+		if _, err := klient.Offsets.Set(context.Background(), offsetID, next, ""); err != nil {
+			return err
+		}
+
+		outputValue(SinkOut{LogID: id, Messages: int64(len(msgs)), NextOffset: next})
+		return nil
+	})
+	if err != nil {
+		return outputErr(err)
+	}
+	return nil
+}
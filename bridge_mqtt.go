@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func bridgeMQTT() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "mqtt",
+		Short: "copy messages between mqtt or nats topics and a log, until interrupted",
+		Args:  cobra.NoArgs,
+	}
+
+	broker := cmd.Flags().String("broker", "tcp://localhost:1883", "broker url, like tcp://host:1883 or ssl://host:8883 for mqtt, or nats://host:4222 for nats")
+	logID := cmd.Flags().String("log-id", "", "log id")
+	subscribe := cmd.Flags().StringArray("subscribe", nil, "topic filter (or nats subject) to publish messages from, with the topic as key")
+	publish := cmd.Flags().String("publish", "", "topic (or nats subject) to publish consumed messages to, '{key}' is replaced with the message key")
+	qos := cmd.Flags().Int("qos", 1, "mqtt quality of service: 0, 1 or 2")
+	clientID := cmd.Flags().String("client-id", "klev-bridge", "mqtt client id, with qos above 0 the broker keeps its session while disconnected")
+	username := cmd.Flags().String("username", "", "broker username")
+	password := cmd.Flags().String("password", "", "broker password")
+	batchSize := cmd.Flags().Int("batch-size", 100, "max messages to publish at once (subscribe)")
+	batchInterval := cmd.Flags().Duration("batch-interval", time.Second, "max time to wait for a batch to fill (subscribe)")
+	offsetID := cmd.Flags().String("offset-id", "", "offset to checkpoint the next offset to publish in (publish)")
+	offset := cmd.Flags().Int64("offset", klev.OffsetOldest, "the starting offset, when the offset is not set (publish)")
+	size := cmd.Flags().Int32("size", 100, "max messages to consume at once (publish)")
+	poll := cmd.Flags().Duration("poll", 10*time.Second, "how long to wait for new messages (publish)")
+
+	cmd.MarkFlagRequired("log-id")
+	cmd.MarkFlagsMutuallyExclusive("subscribe", "publish")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseLogID(*logID)
+		if err != nil {
+			return outputErr(err)
+		}
+		if len(*subscribe) == 0 && *publish == "" {
+			return fmt.Errorf("either '--subscribe' or '--publish' is required")
+		}
+		if *qos < 0 || *qos > 2 {
+			return fmt.Errorf("unknown qos '%d'. Must be one of '0, 1, 2'", *qos)
+		}
+		if *batchSize <= 0 {
+			return fmt.Errorf("batch-size must be positive")
+		}
+
+		u, err := url.Parse(*broker)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid broker '%s'. Must be like 'tcp://host:port'", *broker)
+		}
+
+		var msgs chan bridgeMessage
+		if len(*subscribe) > 0 {
+			msgs = make(chan bridgeMessage, *batchSize)
+		}
+
+		// keys replacing '{key}' can't contain separators or wildcards
+		reserved, wildcards := "/+#\x00", "+#"
+		if u.Scheme == "nats" {
+			reserved, wildcards = ". \t\r\n*>", "*>"
+		}
+		if strings.ContainsAny(strings.ReplaceAll(*publish, "{key}", ""), wildcards) {
+			return fmt.Errorf("invalid publish topic '%s'. Must not contain wildcards", *publish)
+		}
+
+		var conn bridgeConn
+		if u.Scheme == "nats" {
+			conn, err = connectNATS(*broker, *username, *password, *subscribe, msgs)
+		} else {
+			conn, err = connectMQTT(*broker, *clientID, *username, *password, byte(*qos), *subscribe, msgs)
+		}
+		if err != nil {
+			return err
+		}
+		defer conn.close()
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		if *publish != "" {
+			var oid *klev.OffsetID
+			if *offsetID != "" {
+				v, err := klev.ParseOffsetID(*offsetID)
+				if err != nil {
+					return outputErr(err)
+				}
+				oid = &v
+			}
+			return klevToBridge(ctx, conn, *publish, reserved, id, oid, *offset, *size, *poll)
+		}
+		return bridgeToKlev(ctx, id, *batchSize, *batchInterval, msgs)
+	}
+
+	return cmd
+}
+
+// bridgeMessage is a message received from a broker, acked once published
+type bridgeMessage struct {
+	topic   string
+	payload []byte
+	ack     func()
+}
+
+// bridgeConn is a broker connection, which reconnects on its own. it sends
+// messages of its subscriptions to a channel, given when connecting
+type bridgeConn interface {
+	// publish returns once the broker has all messages, at their qos
+	publish(ctx context.Context, topics []string, msgs []klev.ConsumeMessage) error
+	close()
+}
+
+// bridgeShutdownTimeout bounds publishing the last received messages when stopping
+const bridgeShutdownTimeout = 10 * time.Second
+
+// bridgeToKlev publishes received messages in batches, acking them after. once ctx
+// is done, the last batch is published within bridgeShutdownTimeout
+func bridgeToKlev(ctx context.Context, id klev.LogID, batchSize int, batchInterval time.Duration, msgs <-chan bridgeMessage) error {
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	var batch []klev.PublishMessage
+	var acks []func()
+	flush := func(ctx context.Context) error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		var next int64
+		err := retryIf(ctx, klevRetriable, func() error {
+			var err error
+			next, err = klient.Messages.Publish(ctx, id, batch)
+			return err
+		})
+		if err != nil {
+			// not acked, the broker delivers them again
+			return err
+		}
+		for _, ack := range acks {
+			ack()
+		}
+		outputValue(SourceOut{LogID: id, Messages: int64(len(batch)), NextOffset: next})
+		batch, acks = nil, nil
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), bridgeShutdownTimeout)
+			defer cancel()
+			err := flush(ctx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				return fmt.Errorf("%d messages not published before stopping: %w", len(batch), err)
+			}
+			return outputErr(err)
+		case m := <-msgs:
+			batch = append(batch, klev.PublishMessage{Key: []byte(m.topic), Value: m.payload})
+			acks = append(acks, m.ack)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		if err := flush(ctx); err != nil && ctx.Err() == nil {
+			// when interrupted, the batch is published once more before stopping
+			return outputErr(err)
+		}
+	}
+}
+
+// klevToBridge publishes consumed messages to the broker, then checkpoints the next offset to publish
+func klevToBridge(ctx context.Context, conn bridgeConn, topic string, reserved string, id klev.LogID, offsetID *klev.OffsetID, offset int64, size int32, poll time.Duration) error {
+	if offsetID != nil {
+		o, err := klient.Offsets.Get(ctx, *offsetID)
+		if err != nil {
+			return outputErr(err)
+		}
+		if o.LogID != id {
+			return fmt.Errorf("offset %s is for log %s", o.OffsetID, o.LogID)
+		}
+		if o.Value >= 0 {
+			offset = o.Value
+		}
+	}
+
+	_, err := sinkConsume(ctx, id, offset, size, true, poll, func(msgs []klev.ConsumeMessage, next int64) error {
+		if len(msgs) == 0 {
+			return nil
+		}
+
+		topics := make([]string, len(msgs))
+		for i, m := range msgs {
+			t, err := bridgeTopic(topic, m.Key, reserved)
+			if err != nil {
+				return fmt.Errorf("offset %d: %w", m.Offset, err)
+			}
+			topics[i] = t
+		}
+		// the broker may be reconnecting, keep trying until it has the messages
+		if err := retry(ctx, func() error { return conn.publish(ctx, topics, msgs) }); err != nil {
+			return err
+		}
+		if offsetID != nil {
+			if _, err := klient.Offsets.Set(context.Background(), *offsetID, next, ""); err != nil {
+				return err
+			}
+		}
+
+		outputValue(SinkOut{LogID: id, Messages: int64(len(msgs)), NextOffset: next})
+		return nil
+	})
+	switch {
+	case ctx.Err() != nil:
+		return nil
+	case err != nil:
+		return outputErr(err)
+	}
+	return nil
+}
+
+// bridgeTopic replaces '{key}' in the topic with the message key, which must be
+// a single topic level, without any of the reserved characters
+func bridgeTopic(topic string, key []byte, reserved string) (string, error) {
+	if !strings.Contains(topic, "{key}") {
+		return topic, nil
+	}
+	switch k := string(key); {
+	case k == "":
+		return "", fmt.Errorf("empty key for topic '%s'", topic)
+	case !utf8.ValidString(k) || strings.ContainsAny(k, reserved):
+		return "", fmt.Errorf("invalid key '%s' for topic '%s'", k, topic)
+	default:
+		return strings.ReplaceAll(topic, "{key}", k), nil
+	}
+}
+
+type mqttConn struct {
+	client mqtt.Client
+	qos    byte
+	topics []string
+	msgs   chan<- bridgeMessage
+}
+
+func connectMQTT(broker, clientID, username, password string, qos byte, topics []string, msgs chan<- bridgeMessage) (*mqttConn, error) {
+	c := &mqttConn{qos: qos, topics: topics, msgs: msgs}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		// with qos, the broker keeps subscriptions and unacked messages between connections
+		SetCleanSession(qos == 0).
+		SetAutoAckDisabled(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		// a kept session can deliver messages before subscribing again on connect
+		SetDefaultPublishHandler(c.receive).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			fmt.Fprintf(os.Stderr, "connection lost, reconnecting: %v\n", err)
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// subscribe on every connect, in case the broker doesn't have the session
+			if len(c.topics) > 0 {
+				c.subscribe(client)
+			}
+		})
+
+	c.client = mqtt.NewClient(opts)
+	token := c.client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *mqttConn) subscribe(client mqtt.Client) {
+	filters := map[string]byte{}
+	for _, t := range c.topics {
+		filters[t] = c.qos
+	}
+	token := client.SubscribeMultiple(filters, c.receive)
+	if token.Wait() && token.Error() != nil {
+		fmt.Fprintf(os.Stderr, "subscribe failed: %v\n", token.Error())
+	}
+}
+
+func (c *mqttConn) receive(_ mqtt.Client, m mqtt.Message) {
+	if c.msgs == nil {
+		// not subscribing, acked so the broker doesn't deliver it again
+		m.Ack()
+		return
+	}
+	c.msgs <- bridgeMessage{topic: m.Topic(), payload: m.Payload(), ack: m.Ack}
+}
+
+func (c *mqttConn) publish(ctx context.Context, topics []string, msgs []klev.ConsumeMessage) error {
+	tokens := make([]mqtt.Token, len(msgs))
+	for i, m := range msgs {
+		tokens[i] = c.client.Publish(topics[i], c.qos, false, m.Value)
+	}
+	for _, token := range tokens {
+		select {
+		case <-token.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := token.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *mqttConn) close() {
+	c.client.Disconnect(250)
+}
+
+type natsConn struct {
+	conn *nats.Conn
+}
+
+func connectNATS(broker, username, password string, subjects []string, msgs chan<- bridgeMessage) (*natsConn, error) {
+	opts := []nats.Option{
+		nats.Name("klev-bridge"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "connection lost, reconnecting: %v\n", err)
+			}
+		}),
+	}
+	if username != "" {
+		opts = append(opts, nats.UserInfo(username, password))
+	}
+
+	conn, err := nats.Connect(broker, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// subscriptions are restored on reconnect. nats delivers at most once, there is nothing to ack
+	for _, s := range subjects {
+		_, err := conn.Subscribe(s, func(m *nats.Msg) {
+			msgs <- bridgeMessage{topic: m.Subject, payload: m.Data, ack: func() {}}
+		})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &natsConn{conn: conn}, nil
+}
+
+func (c *natsConn) publish(ctx context.Context, subjects []string, msgs []klev.ConsumeMessage) error {
+	if !c.conn.IsConnected() {
+		// published messages are buffered while reconnecting, and lost if it fails
+		return nats.ErrConnectionReconnecting
+	}
+	for i, m := range msgs {
+		if err := c.conn.Publish(subjects[i], m.Value); err != nil {
+			return err
+		}
+	}
+	// the server has the messages once it responds to the ping
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return c.conn.FlushWithContext(ctx)
+}
+
+func (c *natsConn) close() {
+	c.conn.Close()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+// check statuses, ordered by severity. values match nagios exit codes
+type checkStatus int
+
+const (
+	checkOK checkStatus = iota
+	checkWarning
+	checkCritical
+	checkUnknown
+)
+
+func (s checkStatus) String() string {
+	switch s {
+	case checkOK:
+		return "OK"
+	case checkWarning:
+		return "WARNING"
+	case checkCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func (s checkStatus) MarshalText() ([]byte, error) {
+	return []byte(strings.ToLower(s.String())), nil
+}
+
+// worse is used to combine statuses, unknown is only used when nothing is critical
+func (s checkStatus) worse(o checkStatus) checkStatus {
+	rank := func(s checkStatus) int {
+		switch s {
+		case checkCritical:
+			return 3
+		case checkUnknown:
+			return 2
+		case checkWarning:
+			return 1
+		default:
+			return 0
+		}
+	}
+	if rank(o) > rank(s) {
+		return o
+	}
+	return s
+}
+
+// CheckResult is the outcome of a single rule
+type CheckResult struct {
+	Check   string      `json:"check"`
+	ID      string      `json:"id,omitempty"`
+	Status  checkStatus `json:"status"`
+	Message string      `json:"message"`
+}
+
+// CheckOut is the outcome of all rules
+type CheckOut struct {
+	Status  checkStatus   `json:"status"`
+	Results []CheckResult `json:"results"`
+}
+
+type checkThresholds struct {
+	warning  int64
+	critical int64
+}
+
+func (t checkThresholds) eval(v int64) checkStatus {
+	switch {
+	case t.critical > 0 && v >= t.critical:
+		return checkCritical
+	case t.warning > 0 && v >= t.warning:
+		return checkWarning
+	default:
+		return checkOK
+	}
+}
+
+var allChecks = []string{"token", "filters", "egress-webhooks", "offsets", "logs"}
+
+func check() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "check the health of klev resources, nagios style",
+		Args:  cobra.NoArgs,
+		// errors before checking, like a missing token or invalid flags, are unknown
+		Annotations: map[string]string{exitCodeAnnotation: strconv.Itoa(int(checkUnknown))},
+	}
+
+	checks := cmd.Flags().StringSlice("checks", allChecks, "which checks to run")
+	format := cmd.Flags().String("format", "nagios", "output format: nagios or json")
+	var lag, size checkThresholds
+	cmd.Flags().Int64Var(&lag.warning, "offset-lag-warning", 0, "offset lag (in messages) to warn at")
+	cmd.Flags().Int64Var(&lag.critical, "offset-lag-critical", 0, "offset lag (in messages) to be critical at")
+	cmd.Flags().Int64Var(&size.warning, "log-size-warning", 0, "log size (in bytes) to warn at")
+	cmd.Flags().Int64Var(&size.critical, "log-size-critical", 0, "log size (in bytes) to be critical at")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if *format != "nagios" && *format != "json" {
+			return fmt.Errorf("unknown format '%s'. Must be one of 'nagios, json'", *format)
+		}
+
+		var out CheckOut
+		add := func(results ...CheckResult) {
+			for _, r := range results {
+				out.Status = out.Status.worse(r.Status)
+				out.Results = append(out.Results, r)
+			}
+		}
+
+		for _, c := range *checks {
+			switch c {
+			case "token":
+				add(checkToken(cmd.Context()))
+			case "filters":
+				add(checkFilters(cmd.Context())...)
+			case "egress-webhooks":
+				add(checkEgressWebhooks(cmd.Context())...)
+			case "offsets":
+				add(checkOffsets(cmd.Context(), lag)...)
+			case "logs":
+				add(checkLogs(cmd.Context(), size)...)
+			default:
+				return fmt.Errorf("unknown check '%s'. Must be one of '%s'", c, strings.Join(allChecks, ", "))
+			}
+		}
+
+		if *format == "json" {
+			if err := outputValue(out); err != nil {
+				return err
+			}
+		} else {
+			outputNagios(out)
+		}
+		os.Exit(int(out.Status))
+		return nil
+	}
+
+	return cmd
+}
+
+func outputNagios(out CheckOut) {
+	var counts = map[checkStatus]int{}
+	for _, r := range out.Results {
+		counts[r.Status]++
+	}
+	fmt.Printf("KLEV %s - %d critical, %d warning, %d unknown, %d ok\n", out.Status,
+		counts[checkCritical], counts[checkWarning], counts[checkUnknown], counts[checkOK])
+
+	for _, r := range out.Results {
+		if r.ID != "" {
+			fmt.Printf("%s %s %s: %s\n", r.Status, r.Check, r.ID, r.Message)
+		} else {
+			fmt.Printf("%s %s: %s\n", r.Status, r.Check, r.Message)
+		}
+	}
+}
+
+func checkError(check string, id string, err error) CheckResult {
+	return CheckResult{Check: check, ID: id, Status: checkUnknown, Message: err.Error()}
+}
+
+func checkToken(ctx context.Context) CheckResult {
+	if _, err := klient.Paths.Get(ctx); err != nil {
+		return CheckResult{Check: "token", Status: checkCritical, Message: err.Error()}
+	}
+	return CheckResult{Check: "token", Status: checkOK, Message: "token is valid"}
+}
+
+func checkFilters(ctx context.Context) []CheckResult {
+	filters, err := klient.Filters.List(ctx)
+	if err != nil {
+		return []CheckResult{checkError("filters", "", err)}
+	}
+
+	var results []CheckResult
+	for _, f := range filters {
+		status, err := klient.Filters.Status(ctx, f.FilterID)
+		if err != nil {
+			results = append(results, checkError("filter", f.FilterID.String(), err))
+			continue
+		}
+		results = append(results, checkDelivery("filter", f.FilterID.String(),
+			status.Active, status.InactiveReason, status.DeliverError, status.AvailableOffset-status.NextDeliverOffset))
+	}
+	return results
+}
+
+func checkEgressWebhooks(ctx context.Context) []CheckResult {
+	webhooks, err := klient.EgressWebhooks.List(ctx)
+	if err != nil {
+		return []CheckResult{checkError("egress-webhooks", "", err)}
+	}
+
+	var results []CheckResult
+	for _, w := range webhooks {
+		status, err := klient.EgressWebhooks.Status(ctx, w.WebhookID)
+		if err != nil {
+			results = append(results, checkError("egress-webhook", w.WebhookID.String(), err))
+			continue
+		}
+		results = append(results, checkDelivery("egress-webhook", w.WebhookID.String(),
+			status.Active, status.InactiveReason, status.DeliverError, status.AvailableOffset-status.NextDeliverOffset))
+	}
+	return results
+}
+
+// checkDelivery is critical for inactive filters/webhooks, and warns when the last delivery failed
+func checkDelivery(check string, id string, active bool, inactiveReason string, deliverError string, pending int64) CheckResult {
+	switch {
+	case !active:
+		return CheckResult{Check: check, ID: id, Status: checkCritical, Message: fmt.Sprintf("inactive: %s", inactiveReason)}
+	case deliverError != "":
+		return CheckResult{Check: check, ID: id, Status: checkWarning, Message: fmt.Sprintf("delivery failing: %s", deliverError)}
+	default:
+		return CheckResult{Check: check, ID: id, Status: checkOK, Message: fmt.Sprintf("active, %d pending", pending)}
+	}
+}
+
+func checkOffsets(ctx context.Context, lag checkThresholds) []CheckResult {
+	offsets, err := klient.Offsets.List(ctx)
+	if err != nil {
+		return []CheckResult{checkError("offsets", "", err)}
+	}
+
+	var results []CheckResult
+	var heads = map[klev.LogID]int64{}
+	for _, o := range offsets {
+		head, ok := heads[o.LogID]
+		if !ok {
+			head, _, err = klient.Messages.Consume(ctx, o.LogID, klev.ConsumeNewest(), klev.ConsumeLen(1))
+			if err != nil {
+				results = append(results, checkError("offset", o.OffsetID.String(), err))
+				continue
+			}
+			heads[o.LogID] = head
+		}
+
+		l, ok := offsetLag(head, o)
+		if !ok {
+			results = append(results, CheckResult{Check: "offset", ID: o.OffsetID.String(), Status: checkOK, Message: "not set"})
+			continue
+		}
+		results = append(results, CheckResult{Check: "offset", ID: o.OffsetID.String(), Status: lag.eval(l), Message: fmt.Sprintf("lag %d", l)})
+	}
+	return results
+}
+
+// offsetLag is how many messages are in the log after the offset, given the log next offset.
+// an offset that isn't set has no lag
+func offsetLag(head int64, o klev.Offset) (int64, bool) {
+	if o.Value < 0 {
+		return 0, false
+	}
+	if o.Value > head {
+		return 0, true
+	}
+	return head - o.Value, true
+}
+
+func checkLogs(ctx context.Context, size checkThresholds) []CheckResult {
+	logs, err := klient.Logs.List(ctx)
+	if err != nil {
+		return []CheckResult{checkError("logs", "", err)}
+	}
+
+	var results []CheckResult
+	for _, l := range logs {
+		stats, err := klient.Logs.Stats(ctx, l.LogID)
+		if err != nil {
+			results = append(results, checkError("log", l.LogID.String(), err))
+			continue
+		}
+		results = append(results, CheckResult{Check: "log", ID: l.LogID.String(), Status: size.eval(stats.Size),
+			Message: fmt.Sprintf("size %d, count %d", stats.Size, stats.Count)})
+	}
+	return results
+}
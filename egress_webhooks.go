@@ -1,9 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/spf13/cobra"
 
 	"github.com/klev-dev/klev-api-go"
+	"github.com/klev-dev/klev-api-go/ingress_validate"
 )
 
 func egressWebhooksRoot() *cobra.Command {
@@ -19,6 +32,9 @@ func egressWebhooksRoot() *cobra.Command {
 	cmd.AddCommand(egressWebhooksStatus())
 	cmd.AddCommand(egressWebhooksUpdate())
 	cmd.AddCommand(egressWebhooksDelete())
+	cmd.AddCommand(egressWebhooksListen())
+	cmd.AddCommand(egressWebhooksDeliveries())
+	cmd.AddCommand(egressWebhooksRedeliver())
 
 	return cmd
 }
@@ -188,3 +204,315 @@ func egressWebhooksDelete() *cobra.Command {
 		},
 	}
 }
+
+// EgressDeliveryOut describes a delivery received by listen
+type EgressDeliveryOut struct {
+	Time     time.Time               `json:"time"`
+	Secret   string                  `json:"secret"`
+	Payload  string                  `json:"payload"`
+	Encoding klev.MessageEncoding    `json:"encoding"`
+	Message  *klev.ConsumeMessageOut `json:"message,omitempty"`
+	Key      *string                 `json:"key,omitempty"`
+	Value    *string                 `json:"value,omitempty"`
+	Status   int                     `json:"status"`
+}
+
+func egressWebhooksListen() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "listen",
+		Short: "run a local endpoint that verifies and prints egress webhook deliveries",
+		Args:  cobra.NoArgs,
+		// listen only receives from klev, so it doesn't require authtoken
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+	}
+
+	listen := cmd.Flags().String("listen", ":9000", "address to listen on")
+	secret := cmd.Flags().String("secret", "", "secret to validate the payload")
+	oldSecret := cmd.Flags().String("old-secret", "", "previous secret, still valid during rotation")
+	encoding := cmd.Flags().String("encoding", "string", "how to convert message payload")
+	payload := cmd.Flags().String("payload", "value", "what raw deliveries of the webhook contain: key or value")
+	statuses := cmd.Flags().IntSlice("status", []int{http.StatusOK}, "status codes to respond with, cycled through on each delivery")
+	delay := cmd.Flags().Duration("delay", 0, "how long to wait before responding")
+
+	cmd.MarkFlagRequired("secret")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		coder, err := klev.ParseMessageEncoding(*encoding)
+		if err != nil {
+			return outputErr(err)
+		}
+		if len(*statuses) == 0 {
+			return fmt.Errorf("at least one status is required")
+		}
+		data, err := klev.ParseEgressWebhookPayload(*payload)
+		if err != nil || data == klev.EgressWebhookPayloadMessage {
+			return fmt.Errorf("unknown payload '%s'. Must be one of 'key, value'", *payload)
+		}
+
+		secrets := []egressSecret{{"current", *secret}}
+		if *oldSecret != "" {
+			secrets = append(secrets, egressSecret{"old", *oldSecret})
+		}
+
+		var mu sync.Mutex
+		var deliveries int
+
+		http.Handle("/", egressDeliveryHandler(secrets, coder, data, func(out EgressDeliveryOut) int {
+			mu.Lock()
+			out.Status = (*statuses)[deliveries%len(*statuses)]
+			deliveries++
+			outputValue(out)
+			mu.Unlock()
+
+			time.Sleep(*delay)
+			return out.Status
+		}))
+
+		fmt.Fprintf(os.Stderr, "listening for egress webhooks at %s\n", *listen)
+		return http.ListenAndServe(*listen, nil)
+	}
+
+	return cmd
+}
+
+type egressSecret struct {
+	name   string
+	secret string
+}
+
+// egressDeliveryHandler verifies and decodes deliveries, responding with the status returned by handle.
+// raw deliveries contain the data payload, either the message key or value
+func egressDeliveryHandler(secrets []egressSecret, coder klev.MessageEncoding, data klev.EgressWebhookPayload, handle func(out EgressDeliveryOut) int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, err := verifyEgressDelivery(w, r, secrets, coder, data)
+		if err != nil {
+			apiErr := klev.GetError(err)
+			if apiErr == nil {
+				apiErr = &klev.APIError{Message: err.Error()}
+			}
+			outputValueTo(os.Stderr, apiErr)
+			w.WriteHeader(http.StatusBadRequest)
+			outputValueTo(w, apiErr)
+			return
+		}
+		w.WriteHeader(handle(out))
+	})
+}
+
+// verifyEgressDelivery checks the delivery signature against each of the secrets,
+// and decodes it depending on the content type
+func verifyEgressDelivery(w http.ResponseWriter, r *http.Request, secrets []egressSecret, coder klev.MessageEncoding, data klev.EgressWebhookPayload) (EgressDeliveryOut, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 128*1024))
+	if err != nil {
+		return EgressDeliveryOut{}, err
+	}
+
+	out := EgressDeliveryOut{Time: time.Now().UTC(), Encoding: coder}
+	for _, s := range secrets {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if r.Header.Get("Content-Type") == "application/json" {
+			msg, verr := ingress_validate.Message(w, r, time.Now, s.secret)
+			if verr != nil {
+				err = verr
+				continue
+			}
+			out.Secret = s.name
+			out.Payload = klev.EgressWebhookPayloadMessage.String()
+			m := encodeMessage(coder, msg)
+			out.Message = &m
+			return out, nil
+		}
+
+		raw, verr := ingress_validate.Data(w, r, time.Now, s.secret)
+		if verr != nil {
+			err = verr
+			continue
+		}
+		out.Secret = s.name
+		out.Payload = data.String()
+		if data == klev.EgressWebhookPayloadKey {
+			out.Key = coder.EncodeData(raw)
+		} else {
+			out.Value = coder.EncodeData(raw)
+		}
+		return out, nil
+	}
+	return out, err
+}
+
+// EgressDeliveriesOut describes which offsets of the source log are not yet delivered
+type EgressDeliveriesOut struct {
+	WebhookID      klev.EgressWebhookID `json:"webhook_id"`
+	LogID          klev.LogID           `json:"log_id"`
+	Active         bool                 `json:"active"`
+	InactiveReason string               `json:"inactive_reason,omitempty"`
+	DeliverOffset  int64                `json:"deliver_offset"`
+	DeliverError   string               `json:"deliver_error,omitempty"`
+	FromOffset     int64                `json:"from_offset"`
+	ToOffset       int64                `json:"to_offset"`
+	Pending        int64                `json:"pending"`
+}
+
+func egressWebhooksDeliveries() *cobra.Command {
+	return &cobra.Command{
+		Use:   "deliveries <egress-webhook-id>",
+		Short: "list the offsets not yet delivered by an egress webhook",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id, err := klev.ParseEgressWebhookID(args[0])
+			if err != nil {
+				return outputErr(err)
+			}
+
+			webhook, err := klient.EgressWebhooks.Get(cmd.Context(), id)
+			if err != nil {
+				return outputErr(err)
+			}
+
+			status, err := klient.EgressWebhooks.Status(cmd.Context(), id)
+			if err != nil {
+				return outputErr(err)
+			}
+
+			// the log might have moved past the status available offset, or trimmed
+			// messages that were never delivered
+			head, _, err := klient.Messages.Consume(cmd.Context(), webhook.LogID, klev.ConsumeNewest(), klev.ConsumeLen(1))
+			if err != nil {
+				return outputErr(err)
+			}
+			from := status.NextDeliverOffset
+			if _, msgs, err := klient.Messages.Consume(cmd.Context(), webhook.LogID, klev.ConsumeOffset(from), klev.ConsumeLen(1)); err != nil {
+				return outputErr(err)
+			} else if len(msgs) > 0 && msgs[0].Offset > from {
+				from = msgs[0].Offset
+			}
+
+			out := EgressDeliveriesOut{
+				WebhookID:      webhook.WebhookID,
+				LogID:          webhook.LogID,
+				Active:         status.Active,
+				InactiveReason: status.InactiveReason,
+				DeliverOffset:  status.DeliverOffset,
+				DeliverError:   status.DeliverError,
+				FromOffset:     from,
+				ToOffset:       head - 1,
+			}
+			if head > from {
+				out.Pending = head - from
+			}
+			return outputValue(out)
+		},
+	}
+}
+
+// EgressRedeliverOut is the result of redelivering a single message
+type EgressRedeliverOut struct {
+	Offset int64  `json:"offset"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func egressWebhooksRedeliver() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "redeliver <egress-webhook-id>",
+		Short: "deliver messages again to an egress webhook destination",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	fromOffset := cmd.Flags().Int64("from-offset", 0, "first offset to deliver")
+	toOffset := cmd.Flags().Int64("to-offset", 0, "last offset to deliver")
+	secret := cmd.Flags().String("secret", "", "secret to sign the payload, if the webhook doesn't return it")
+
+	cmd.MarkFlagRequired("from-offset")
+	cmd.MarkFlagRequired("to-offset")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseEgressWebhookID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		webhook, err := klient.EgressWebhooks.Get(cmd.Context(), id)
+		if err != nil {
+			return outputErr(err)
+		}
+		if cmd.Flags().Changed("secret") {
+			webhook.Secret = *secret
+		}
+		if webhook.Secret == "" {
+			return fmt.Errorf("webhook secret is not available, pass it with '--secret'")
+		}
+
+		offset := *fromOffset
+		for offset <= *toOffset {
+			next, msgs, err := klient.Messages.Consume(cmd.Context(), webhook.LogID, klev.ConsumeOffset(offset))
+			if err != nil {
+				return outputErr(err)
+			}
+			if len(msgs) == 0 {
+				break
+			}
+
+			for _, msg := range msgs {
+				if msg.Offset > *toOffset {
+					break
+				}
+
+				out := EgressRedeliverOut{Offset: msg.Offset}
+				if status, err := deliverEgress(cmd.Context(), webhook, msg); err != nil {
+					out.Error = err.Error()
+				} else {
+					out.Status = status
+				}
+				if err := outputValue(out); err != nil {
+					return err
+				}
+			}
+			offset = next
+		}
+
+		return nil
+	}
+
+	return cmd
+}
+
+// deliverEgress sends a message to the webhook destination, encoded and signed like klev does
+func deliverEgress(ctx context.Context, webhook klev.EgressWebhook, msg klev.ConsumeMessage) (int, error) {
+	var body []byte
+	var contentType string
+	switch webhook.Payload {
+	case klev.EgressWebhookPayloadMessage:
+		b, err := json.Marshal(encodeGetOut(msg))
+		if err != nil {
+			return 0, err
+		}
+		body, contentType = b, "application/json"
+	case klev.EgressWebhookPayloadKey:
+		body, contentType = msg.Key, "application/octet-stream"
+	case klev.EgressWebhookPayloadValue:
+		body, contentType = msg.Value, "application/octet-stream"
+	default:
+		return 0, klev.ErrEgressWebhookPayloadInvalid(webhook.Payload.String(), "message, key, value")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Destination, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Klev-Signature", fmt.Sprintf("t=%s;v1=%s", ts, hex.EncodeToString(ingress_validate.Signature(ts, body, webhook.Secret))))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
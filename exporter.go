@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func exporter() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "exporter",
+		Short: "serve klev metrics in prometheus format",
+		Args:  cobra.NoArgs,
+	}
+
+	listen := cmd.Flags().String("listen", ":9100", "address to listen on")
+	interval := cmd.Flags().Duration("interval", 30*time.Second, "how often to collect metrics from klev")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		var mu sync.RWMutex
+		var current []byte
+
+		collect := func() {
+			b := collectMetrics(cmd.Context())
+			mu.Lock()
+			current = b
+			mu.Unlock()
+		}
+		collect()
+
+		go func() {
+			ticker := time.NewTicker(*interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					collect()
+				case <-cmd.Context().Done():
+					return
+				}
+			}
+		}()
+
+		http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			mu.RLock()
+			defer mu.RUnlock()
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			w.Write(current)
+		})
+
+		fmt.Fprintf(os.Stderr, "serving metrics at %s/metrics\n", *listen)
+		return http.ListenAndServe(*listen, nil)
+	}
+
+	return cmd
+}
+
+// collectMetrics queries klev and renders the results in prometheus text format
+func collectMetrics(ctx context.Context) []byte {
+	start := time.Now()
+	m := newPromMetrics()
+	var errs int
+
+	logHeads := map[klev.LogID]int64{}
+	if logs, err := klient.Logs.List(ctx); err != nil {
+		errs++
+	} else {
+		for _, l := range logs {
+			labels := promLabels{"log_id", l.LogID.String(), "metadata", l.Metadata}
+
+			if stats, err := klient.Logs.Stats(ctx, l.LogID); err != nil {
+				errs++
+			} else {
+				m.gauge("klev_log_size_bytes", "size of the log in bytes", labels, float64(stats.Size))
+				m.gauge("klev_log_messages", "number of messages in the log", labels, float64(stats.Count))
+			}
+
+			if head, _, err := klient.Messages.Consume(ctx, l.LogID, klev.ConsumeNewest(), klev.ConsumeLen(1)); err != nil {
+				errs++
+			} else {
+				logHeads[l.LogID] = head
+				m.gauge("klev_log_next_offset", "offset of the next message published to the log", labels, float64(head))
+			}
+		}
+	}
+
+	if offsets, err := klient.Offsets.List(ctx); err != nil {
+		errs++
+	} else {
+		for _, o := range offsets {
+			labels := promLabels{"offset_id", o.OffsetID.String(), "log_id", o.LogID.String(), "metadata", o.Metadata}
+			m.gauge("klev_offset_value", "value of the offset", labels, float64(o.Value))
+			if head, ok := logHeads[o.LogID]; ok {
+				if lag, ok := offsetLag(head, o); ok {
+					m.gauge("klev_offset_lag", "messages in the log after the offset", labels, float64(lag))
+				}
+			}
+		}
+	}
+
+	if filters, err := klient.Filters.List(ctx); err != nil {
+		errs++
+	} else {
+		for _, f := range filters {
+			status, err := klient.Filters.Status(ctx, f.FilterID)
+			if err != nil {
+				errs++
+				continue
+			}
+			labels := promLabels{"filter_id", f.FilterID.String(), "source_id", f.Source.String(), "target_id", f.Target.String(), "metadata", f.Metadata}
+			m.gauge("klev_filter_active", "1 if the filter is active", labels, promBool(status.Active))
+			m.gauge("klev_filter_error", "1 if the last filter delivery failed", labels, promBool(status.DeliverError != ""))
+			m.gauge("klev_filter_pending", "messages waiting to be filtered", labels, float64(status.AvailableOffset-status.NextDeliverOffset))
+		}
+	}
+
+	if webhooks, err := klient.EgressWebhooks.List(ctx); err != nil {
+		errs++
+	} else {
+		for _, w := range webhooks {
+			status, err := klient.EgressWebhooks.Status(ctx, w.WebhookID)
+			if err != nil {
+				errs++
+				continue
+			}
+			labels := promLabels{"webhook_id", w.WebhookID.String(), "log_id", w.LogID.String(), "metadata", w.Metadata}
+			m.gauge("klev_egress_webhook_active", "1 if the egress webhook is active", labels, promBool(status.Active))
+			m.gauge("klev_egress_webhook_error", "1 if the last egress webhook delivery failed", labels, promBool(status.DeliverError != ""))
+			m.gauge("klev_egress_webhook_pending", "messages waiting to be delivered", labels, float64(status.AvailableOffset-status.NextDeliverOffset))
+		}
+	}
+
+	m.gauge("klev_scrape_errors", "number of failed klev requests during the last collection", nil, float64(errs))
+	m.gauge("klev_scrape_duration_seconds", "how long the last collection took", nil, time.Since(start).Seconds())
+	return m.render()
+}
+
+// promLabels are label name and value pairs
+type promLabels []string
+
+type promSample struct {
+	labels promLabels
+	value  float64
+}
+
+type promFamily struct {
+	help    string
+	typ     string
+	samples []promSample
+}
+
+type promMetrics struct {
+	families map[string]*promFamily
+}
+
+func newPromMetrics() *promMetrics {
+	return &promMetrics{families: map[string]*promFamily{}}
+}
+
+func (m *promMetrics) gauge(name string, help string, labels promLabels, value float64) {
+	f, ok := m.families[name]
+	if !ok {
+		f = &promFamily{help: help, typ: "gauge"}
+		m.families[name] = f
+	}
+	f.samples = append(f.samples, promSample{labels, value})
+}
+
+func (m *promMetrics) render() []byte {
+	var names []string
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := m.families[name]
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, f.typ)
+		for _, s := range f.samples {
+			buf.WriteString(name)
+			if len(s.labels) > 0 {
+				buf.WriteByte('{')
+				for i := 0; i < len(s.labels); i += 2 {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(&buf, "%s=\"%s\"", s.labels[i], promEscape(s.labels[i+1]))
+				}
+				buf.WriteByte('}')
+			}
+			fmt.Fprintf(&buf, " %g\n", s.value)
+		}
+	}
+	return buf.Bytes()
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
+
+func promBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func TestPromMetricsRender(t *testing.T) {
+	type sample struct {
+		name   string
+		help   string
+		labels promLabels
+		value  float64
+	}
+	tests := []struct {
+		name    string
+		samples []sample
+		out     string
+	}{
+		{
+			name: "empty",
+			out:  "",
+		},
+		{
+			name:    "without labels",
+			samples: []sample{{"klev_scrape_errors", "failed requests", nil, 0}},
+			out: "# HELP klev_scrape_errors failed requests\n" +
+				"# TYPE klev_scrape_errors gauge\n" +
+				"klev_scrape_errors 0\n",
+		},
+		{
+			name: "labels",
+			samples: []sample{
+				{"klev_log_messages", "messages in the log", promLabels{"log_id", "log_a", "metadata", ""}, 42},
+				{"klev_log_messages", "messages in the log", promLabels{"log_id", "log_b", "metadata", "orders"}, 7},
+			},
+			out: "# HELP klev_log_messages messages in the log\n" +
+				"# TYPE klev_log_messages gauge\n" +
+				"klev_log_messages{log_id=\"log_a\",metadata=\"\"} 42\n" +
+				"klev_log_messages{log_id=\"log_b\",metadata=\"orders\"} 7\n",
+		},
+		{
+			name: "families sorted by name",
+			samples: []sample{
+				{"klev_b", "b", nil, 1},
+				{"klev_a", "a", nil, 2},
+				{"klev_b", "b", nil, 3},
+			},
+			out: "# HELP klev_a a\n# TYPE klev_a gauge\nklev_a 2\n" +
+				"# HELP klev_b b\n# TYPE klev_b gauge\nklev_b 1\nklev_b 3\n",
+		},
+		{
+			name:    "escaped label values",
+			samples: []sample{{"klev_offset_value", "value", promLabels{"metadata", "a \"quoted\" C:\\path\nline"}, -1}},
+			out: "# HELP klev_offset_value value\n" +
+				"# TYPE klev_offset_value gauge\n" +
+				"klev_offset_value{metadata=\"a \\\"quoted\\\" C:\\\\path\\nline\"} -1\n",
+		},
+		{
+			name: "values",
+			samples: []sample{
+				{"klev_v", "v", promLabels{"n", "large"}, 12345678901},
+				{"klev_v", "v", promLabels{"n", "fraction"}, 0.25},
+				{"klev_v", "v", promLabels{"n", "bool"}, promBool(true)},
+			},
+			out: "# HELP klev_v v\n# TYPE klev_v gauge\n" +
+				"klev_v{n=\"large\"} 1.2345678901e+10\n" +
+				"klev_v{n=\"fraction\"} 0.25\n" +
+				"klev_v{n=\"bool\"} 1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newPromMetrics()
+			for _, s := range tt.samples {
+				m.gauge(s.name, s.help, s.labels, s.value)
+			}
+			if out := string(m.render()); out != tt.out {
+				t.Fatalf("expected:\n%s\ngot:\n%s", tt.out, out)
+			}
+		})
+	}
+}
+
+func TestOffsetLag(t *testing.T) {
+	tests := []struct {
+		name  string
+		head  int64
+		value int64
+		lag   int64
+		set   bool
+	}{
+		{"not set", 10, -1, 0, false},
+		{"caught up", 10, 10, 0, true},
+		{"behind", 10, 3, 7, true},
+		{"empty log", 0, 0, 0, true},
+		{"ahead of the log", 10, 12, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lag, set := offsetLag(tt.head, klev.Offset{Value: tt.value})
+			if lag != tt.lag || set != tt.set {
+				t.Fatalf("expected %d %v, got %d %v", tt.lag, tt.set, lag, set)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func streamGateway() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stream-gateway",
+		Short: "stream logs to browsers over server-sent events or websockets",
+		Args:  cobra.NoArgs,
+	}
+
+	listen := cmd.Flags().String("listen", ":8081", "address to listen on")
+	allowLogs := cmd.Flags().StringArray("allow-log", nil, "log that clients can stream, at /logs/<log-id>")
+	allowOrigins := cmd.Flags().StringArray("allow-origin", nil, "origin of pages that can stream, like https://dash.example.com. defaults to same origin")
+	apiKeys := cmd.Flags().StringArray("api-key", nil, "key that clients must send as 'Authorization: Bearer <key>' or an 'api_key' query parameter")
+	insecureNoAuth := cmd.Flags().Bool("insecure-no-auth", false, "allow clients to stream without an api key")
+	encoding := cmd.Flags().String("encoding", "string", "how to convert message payload")
+	size := cmd.Flags().Int32("size", 100, "max messages to consume per request")
+	poll := cmd.Flags().Duration("poll", 30*time.Second, "how long to wait for new messages, before sending a keepalive")
+
+	cmd.MarkFlagRequired("allow-log")
+	cmd.MarkFlagsMutuallyExclusive("api-key", "insecure-no-auth")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if len(*apiKeys) == 0 && !*insecureNoAuth {
+			return fmt.Errorf("either '--api-key' or '--insecure-no-auth' is required")
+		}
+
+		coder, err := klev.ParseMessageEncoding(*encoding)
+		if err != nil {
+			return outputErr(err)
+		}
+
+		logs := map[klev.LogID]bool{}
+		for _, l := range *allowLogs {
+			id, err := klev.ParseLogID(l)
+			if err != nil {
+				return outputErr(err)
+			}
+			logs[id] = true
+		}
+
+		g := &gateway{
+			coder:   coder,
+			size:    *size,
+			poll:    *poll,
+			origins: *allowOrigins,
+		}
+		g.upgrader.CheckOrigin = g.checkOrigin
+
+		http.HandleFunc("/logs/", func(w http.ResponseWriter, r *http.Request) {
+			g.cors(w, r)
+
+			id, err := klev.ParseLogID(strings.TrimPrefix(r.URL.Path, "/logs/"))
+			switch {
+			case r.Method == http.MethodOptions:
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Last-Event-ID")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			case r.Method != http.MethodGet:
+				w.Header().Set("Allow", http.MethodGet)
+				writeHTTPError(w, http.StatusMethodNotAllowed, fmt.Errorf("only GET is allowed"))
+				return
+			case !*insecureNoAuth && !authorizedStreamKey(r, *apiKeys):
+				writeHTTPError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid api key"))
+				return
+			case err != nil || !logs[id]:
+				// checked after the api key, so clients without one can't probe for logs
+				writeHTTPError(w, http.StatusNotFound, fmt.Errorf("no stream for %s", r.URL.Path))
+				return
+			}
+
+			offset, err := streamOffset(r)
+			if err != nil {
+				writeHTTPError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			if websocket.IsWebSocketUpgrade(r) {
+				g.serveWebSocket(w, r, id, offset)
+			} else {
+				g.serveSSE(w, r, id, offset)
+			}
+		})
+
+		fmt.Fprintf(os.Stderr, "streaming logs at %s/logs/<log-id>\n", *listen)
+		return http.ListenAndServe(*listen, nil)
+	}
+
+	return cmd
+}
+
+// gateway streams logs to clients, each running its own consume loop
+type gateway struct {
+	coder    klev.MessageEncoding
+	size     int32
+	poll     time.Duration
+	origins  []string
+	upgrader websocket.Upgrader
+}
+
+func (g *gateway) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range g.origins {
+		if o == origin || o == "*" {
+			return true
+		}
+	}
+	return origin == "http://"+r.Host || origin == "https://"+r.Host
+}
+
+func (g *gateway) cors(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && g.checkOrigin(r) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Vary", "Origin")
+	}
+}
+
+func authorizedStreamKey(r *http.Request, keys []string) bool {
+	if key := r.URL.Query().Get("api_key"); key != "" {
+		// browsers can't set headers on EventSource and WebSocket
+		r.Header.Set("X-Api-Key", key)
+	}
+	return authorizedAPIKey(r, keys)
+}
+
+// streamOffset is the offset to start at. clients resume after the last event id
+// they received (the offset of the last message), or start at an offset
+func streamOffset(r *http.Request) (int64, error) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		last, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || last < 0 {
+			return 0, fmt.Errorf("invalid last event id '%s'", lastEventID)
+		}
+		return last + 1, nil
+	}
+
+	if offset := r.URL.Query().Get("offset"); offset != "" {
+		v, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid offset '%s'", offset)
+		}
+		return v, nil
+	}
+	return klev.OffsetNewest, nil
+}
+
+// stream runs the consume loop, calling send with each batch of messages
+func (g *gateway) stream(ctx context.Context, id klev.LogID, offset int64, send func([]klev.ConsumeMessageOut) error) error {
+	for {
+		next, msgs, err := klient.Messages.Consume(ctx, id, klev.ConsumeOffset(offset), klev.ConsumeLen(g.size), klev.ConsumePoll(g.poll))
+		if err != nil {
+			return err
+		}
+		if err := send(encodeMessages(g.coder, msgs)); err != nil {
+			return err
+		}
+		offset = next
+	}
+}
+
+func (g *gateway) serveSSE(w http.ResponseWriter, r *http.Request, id klev.LogID, offset int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err := g.stream(r.Context(), id, offset, func(msgs []klev.ConsumeMessageOut) error {
+		if len(msgs) == 0 {
+			// keep the connection open through proxies
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return err
+			}
+		}
+		for _, m := range msgs {
+			b, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", m.Offset, b); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil && r.Context().Err() == nil {
+		// the browser will reconnect, resuming with Last-Event-ID
+		b, _ := json.Marshal(toAPIError(err))
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+		flusher.Flush()
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (g *gateway) serveWebSocket(w http.ResponseWriter, r *http.Request, id klev.LogID, offset int64) {
+	conn, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already responded
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		// clients only send control messages, reading handles them and detects closing
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = g.stream(ctx, id, offset, func(msgs []klev.ConsumeMessageOut) error {
+		if len(msgs) == 0 {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+		}
+		for _, m := range msgs {
+			if err := conn.WriteJSON(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, err)
+		conn.WriteJSON(struct {
+			Error *klev.APIError `json:"error"`
+		}{toAPIError(err)})
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""), time.Now().Add(time.Second))
+	}
+}
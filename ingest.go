@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func httpIngest() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "http-ingest",
+		Short: "accept POSTs from local services and publish their bodies to logs",
+		Args:  cobra.NoArgs,
+	}
+
+	listen := cmd.Flags().String("listen", ":8080", "address to listen on")
+	routes := cmd.Flags().StringArray("route", nil, "path and log to publish its requests to, as /path=log_id")
+	keyHeader := cmd.Flags().String("key-header", "", "request header with the message key")
+	keyPointer := cmd.Flags().String("key-pointer", "", "json pointer (like /order/id) to the message key in the request body")
+	apiKeys := cmd.Flags().StringArray("api-key", nil, "key that callers must send as 'Authorization: Bearer <key>' or 'X-Api-Key: <key>'")
+	apiKeysFile := cmd.Flags().String("api-keys-file", "", "file with an api key per line")
+	maxBody := cmd.Flags().Int64("max-body", 1024*1024, "max size of a request body, in bytes")
+
+	cmd.MarkFlagRequired("route")
+	cmd.MarkFlagsMutuallyExclusive("key-header", "key-pointer")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		logs := map[string]klev.LogID{}
+		for _, r := range *routes {
+			path, log, ok := strings.Cut(r, "=")
+			if !ok || !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("invalid route '%s'. Must be like '/path=log_id'", r)
+			}
+			id, err := klev.ParseLogID(log)
+			if err != nil {
+				return outputErr(err)
+			}
+			logs[path] = id
+		}
+
+		var pointer []string
+		if *keyPointer != "" {
+			var err error
+			if pointer, err = parseJSONPointer(*keyPointer); err != nil {
+				return err
+			}
+		}
+
+		keys := *apiKeys
+		if *apiKeysFile != "" {
+			fileKeys, err := readAPIKeys(*apiKeysFile)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, fileKeys...)
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("at least one api key is required, with '--api-key' or '--api-keys-file'")
+		}
+
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			id, ok := logs[r.URL.Path]
+			switch {
+			case !ok:
+				writeHTTPError(w, http.StatusNotFound, fmt.Errorf("no route for %s", r.URL.Path))
+				return
+			case r.Method != http.MethodPost:
+				w.Header().Set("Allow", http.MethodPost)
+				writeHTTPError(w, http.StatusMethodNotAllowed, fmt.Errorf("only POST is allowed"))
+				return
+			case !authorizedAPIKey(r, keys):
+				writeHTTPError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid api key"))
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, *maxBody))
+			if err != nil {
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) {
+					writeHTTPError(w, http.StatusRequestEntityTooLarge, err)
+				} else {
+					writeHTTPError(w, http.StatusBadRequest, err)
+				}
+				return
+			}
+
+			var key []byte
+			switch {
+			case *keyHeader != "":
+				if v := r.Header.Get(*keyHeader); v != "" {
+					key = []byte(v)
+				}
+			case pointer != nil:
+				if key, err = jsonPointerKey(body, pointer); err != nil {
+					writeHTTPError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+
+			next, err := klient.Messages.Post(r.Context(), id, time.Time{}, key, body)
+			if err != nil {
+				writeHTTPError(w, http.StatusBadGateway, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			outputValueTo(w, klev.PostOut{NextOffset: next})
+		})
+
+		fmt.Fprintf(os.Stderr, "listening for requests at %s\n", *listen)
+		return http.ListenAndServe(*listen, nil)
+	}
+
+	return cmd
+}
+
+// writeHTTPError responds with the error as json, also printing it on stderr
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	apiErr := toAPIError(err)
+	outputValueTo(os.Stderr, apiErr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	outputValueTo(w, apiErr)
+}
+
+// toAPIError keeps klev errors, wrapping any other
+func toAPIError(err error) *klev.APIError {
+	if apiErr := klev.GetError(err); apiErr != nil {
+		return apiErr
+	}
+	return &klev.APIError{Message: err.Error()}
+}
+
+func readAPIKeys(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys, scanner.Err()
+}
+
+func authorizedAPIKey(r *http.Request, keys []string) bool {
+	key := r.Header.Get("X-Api-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		return false
+	}
+
+	var found bool
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// parseJSONPointer splits a RFC 6901 pointer into its unescaped tokens
+func parseJSONPointer(p string) ([]string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid json pointer '%s'. Must start with '/'", p)
+	}
+
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// jsonPointerKey finds the value at pointer in a json body. strings and numbers
+// are used as they are, other values as json
+func jsonPointerKey(body []byte, pointer []string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("body is not valid json: %w", err)
+	}
+
+	v, err := jsonPointerValue(doc, pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(v), nil
+	case json.Number:
+		return []byte(v.String()), nil
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// jsonPointerValue walks a decoded json document to the value at pointer
+func jsonPointerValue(v any, pointer []string) (any, error) {
+	for _, t := range pointer {
+		switch node := v.(type) {
+		case map[string]any:
+			child, ok := node[t]
+			if !ok {
+				return nil, fmt.Errorf("key not found at '%s'", t)
+			}
+			v = child
+		case []any:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("key not found at '%s'", t)
+			}
+			v = node[i]
+		default:
+			return nil, fmt.Errorf("key not found at '%s'", t)
+		}
+	}
+	return v, nil
+}
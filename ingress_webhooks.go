@@ -1,9 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
 	"github.com/spf13/cobra"
 
 	"github.com/klev-dev/klev-api-go"
+	"github.com/klev-dev/klev-api-go/ingress_validate"
 )
 
 func ingressWebhooksRoot() *cobra.Command {
@@ -17,6 +33,8 @@ func ingressWebhooksRoot() *cobra.Command {
 	cmd.AddCommand(ingressWebhooksGet())
 	cmd.AddCommand(ingressWebhooksUpdate())
 	cmd.AddCommand(ingressWebhooksDelete())
+	cmd.AddCommand(ingressWebhooksSend())
+	cmd.AddCommand(ingressWebhooksRotate())
 
 	return cmd
 }
@@ -56,14 +74,23 @@ func ingressWebhooksCreate() *cobra.Command {
 	cmd.Flags().StringVar(&in.Metadata, "metadata", "", "machine readable metadata")
 	typ := cmd.Flags().String("type", "", "the type of the webhook")
 	cmd.Flags().StringVar(&in.Secret, "secret", "", "the secret to validate webhook messages")
+	generate := cmd.Flags().Bool("generate-secret", false, "generate a strong secret and print it once")
 
 	cmd.MarkFlagRequired("log-id")
 	cmd.MarkFlagRequired("type")
-	cmd.MarkFlagRequired("secret")
+	cmd.MarkFlagsMutuallyExclusive("secret", "generate-secret")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
 		var err error
 
+		if *generate {
+			if in.Secret, err = generateSecret(); err != nil {
+				return outputErr(err)
+			}
+		} else if in.Secret == "" {
+			return fmt.Errorf("secret is required, pass it with '--secret' or use '--generate-secret'")
+		}
+
 		in.LogID, err = klev.ParseLogID(*logID)
 		if err != nil {
 			return outputErr(err)
@@ -75,7 +102,10 @@ func ingressWebhooksCreate() *cobra.Command {
 		}
 
 		out, err := klient.IngressWebhooks.Create(cmd.Context(), in)
-		return output(out, err)
+		if err != nil || !*generate {
+			return output(out, err)
+		}
+		return outputValue(IngressWebhookSecretOut{out, in.Secret})
 	}
 
 	return cmd
@@ -107,6 +137,9 @@ func ingressWebhooksUpdate() *cobra.Command {
 
 	metadata := cmd.Flags().String("metadata", "", "machine readable metadata")
 	secret := cmd.Flags().String("secret", "", "the secret to validate webhook messages")
+	generate := cmd.Flags().Bool("generate-secret", false, "generate a strong secret and print it once")
+
+	cmd.MarkFlagsMutuallyExclusive("secret", "generate-secret")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
 		id, err := klev.ParseIngressWebhookID(args[0])
@@ -122,9 +155,18 @@ func ingressWebhooksUpdate() *cobra.Command {
 		if cmd.Flags().Changed("secret") {
 			in.Secret = secret
 		}
+		if *generate {
+			if *secret, err = generateSecret(); err != nil {
+				return outputErr(err)
+			}
+			in.Secret = secret
+		}
 
 		out, err := klient.IngressWebhooks.UpdateRaw(cmd.Context(), id, in)
-		return output(out, err)
+		if err != nil || !*generate {
+			return output(out, err)
+		}
+		return outputValue(IngressWebhookSecretOut{out, *secret})
 	}
 
 	return cmd
@@ -146,3 +188,270 @@ func ingressWebhooksDelete() *cobra.Command {
 		},
 	}
 }
+
+// IngressSendOut is the result of sending a test payload to an ingress webhook
+type IngressSendOut struct {
+	URL      string           `json:"url"`
+	Status   int              `json:"status"`
+	Response string           `json:"response,omitempty"`
+	Log      *klev.ConsumeOut `json:"log,omitempty"`
+}
+
+func ingressWebhooksSend() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "send <ingress-webhook-id>",
+		Short: "send a signed test payload to an ingress webhook",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	payload := cmd.Flags().String("payload", "", "a file to read the payload from")
+	secret := cmd.Flags().String("secret", "", "the secret of the webhook")
+	event := cmd.Flags().String("event", "ping", "the event type, for providers that send it in a header")
+	url := cmd.Flags().String("url", "", "where to send the payload, the url the provider delivers the webhook to")
+	wait := cmd.Flags().Duration("wait", 10*time.Second, "how long to wait for the message in the webhook log, 0 to not wait")
+	encoding := cmd.Flags().String("encoding", "string", "how to convert message payload")
+
+	cmd.MarkFlagRequired("payload")
+	cmd.MarkFlagRequired("secret")
+	cmd.MarkFlagRequired("url")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseIngressWebhookID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		coder, err := klev.ParseMessageEncoding(*encoding)
+		if err != nil {
+			return outputErr(err)
+		}
+
+		body, err := os.ReadFile(*payload)
+		if err != nil {
+			return outputErr(err)
+		}
+
+		webhook, err := klient.IngressWebhooks.Get(cmd.Context(), id)
+		if err != nil {
+			return outputErr(err)
+		}
+
+		out, err := sendIngress(cmd.Context(), webhook, *secret, *event, body, *url, *wait, coder)
+		if err != nil {
+			return outputErr(err)
+		}
+		return outputValue(out)
+	}
+
+	return cmd
+}
+
+// sendIngress signs and posts body to target, then waits for messages in the webhook log
+func sendIngress(ctx context.Context, webhook klev.IngressWebhook, secret string, event string, body []byte, target string, wait time.Duration, coder klev.MessageEncoding) (IngressSendOut, error) {
+	var next int64
+	if wait > 0 {
+		var err error
+		next, _, err = klient.Messages.Consume(ctx, webhook.LogID, klev.ConsumeNewest(), klev.ConsumeLen(1))
+		if err != nil {
+			return IngressSendOut{}, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return IngressSendOut{}, err
+	}
+	if err := signIngress(req.Header, webhook.Type, secret, event, body, time.Now()); err != nil {
+		return IngressSendOut{}, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return IngressSendOut{}, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return IngressSendOut{}, err
+	}
+
+	out := IngressSendOut{
+		URL:      target,
+		Status:   resp.StatusCode,
+		Response: string(respBody),
+	}
+	if wait > 0 && resp.StatusCode < 300 {
+		next, msgs, err := klient.Messages.Consume(ctx, webhook.LogID, klev.ConsumeOffset(next), klev.ConsumePoll(wait))
+		if err != nil {
+			return IngressSendOut{}, err
+		}
+		out.Log = &klev.ConsumeOut{
+			NextOffset: next,
+			Encoding:   coder,
+			Messages:   encodeMessages(coder, msgs),
+		}
+	}
+	return out, nil
+}
+
+// signIngress sets the content type and signature headers, the way each provider does
+func signIngress(h http.Header, typ klev.IngressWebhookType, secret string, event string, body []byte, now time.Time) error {
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	switch typ {
+	case klev.IngressWebhookTypeGitHub:
+		delivery := make([]byte, 16)
+		if _, err := rand.Read(delivery); err != nil {
+			return err
+		}
+		h.Set("Content-Type", "application/json")
+		h.Set("X-GitHub-Event", event)
+		h.Set("X-GitHub-Delivery", hex.EncodeToString(delivery))
+		h.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(hmacSHA256(secret, body)))
+	case klev.IngressWebhookTypeStripe:
+		h.Set("Content-Type", "application/json")
+		h.Set("Stripe-Signature", fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(hmacSHA256(secret, []byte(ts+"."), body))))
+	case klev.IngressWebhookTypeSlack:
+		h.Set("Content-Type", "application/json")
+		h.Set("X-Slack-Request-Timestamp", ts)
+		h.Set("X-Slack-Signature", "v0="+hex.EncodeToString(hmacSHA256(secret, []byte("v0:"+ts+":"), body)))
+	case klev.IngressWebhookTypeKlevMessage:
+		h.Set("Content-Type", "application/json")
+		h.Set("X-Klev-Signature", fmt.Sprintf("t=%s;v1=%s", ts, hex.EncodeToString(ingress_validate.Signature(ts, body, secret))))
+	case klev.IngressWebhookTypeKlevKey, klev.IngressWebhookTypeKlevValue:
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("X-Klev-Signature", fmt.Sprintf("t=%s;v1=%s", ts, hex.EncodeToString(ingress_validate.Signature(ts, body, secret))))
+	default:
+		return klev.ErrIngressWebhookTypeInvalid(typ.String(), "gitHub, klev-message, klev-key, klev-value, slack, stripe")
+	}
+	return nil
+}
+
+func hmacSHA256(secret string, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+// IngressWebhookSecretOut is an ingress webhook, together with its newly set secret
+type IngressWebhookSecretOut struct {
+	klev.IngressWebhook
+	Secret string `json:"secret"`
+}
+
+// IngressRotateOut is the result of rotating an ingress webhook secret
+type IngressRotateOut struct {
+	IngressWebhookSecretOut
+	Verify *IngressSendOut `json:"verify,omitempty"`
+}
+
+func ingressWebhooksRotate() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rotate <ingress-webhook-id>",
+		Short: "rotate ingress webhook secret",
+		Long: `rotate ingress webhook secret
+
+Generates a new secret (or uses --secret) and prints it, so it can be configured
+at the provider. After --wait (or after confirmation, when --wait is not set) the
+webhook is updated to the new secret and, if --verify-payload is given,
+a payload signed with the new secret is sent to --url to verify the webhook
+accepts it.
+
+An ingress webhook has a single secret, so the old and the new secret are never
+valid at the same time. Deliveries signed with the secret the webhook doesn't
+use, between updating the provider and switching the webhook, are rejected and
+only arrive if the provider retries them. Rotating requires accepting this with
+--accept-rejected-deliveries.`,
+		Args: cobra.ExactArgs(1),
+	}
+
+	secret := cmd.Flags().String("secret", "", "the new secret, generated when not set")
+	wait := cmd.Flags().Duration("wait", 0, "how long to wait before switching to the new secret, prompts when not set")
+	verifyPayload := cmd.Flags().String("verify-payload", "", "a file with a payload to send, to verify the new secret")
+	event := cmd.Flags().String("event", "ping", "the event type of the verify payload")
+	url := cmd.Flags().String("url", "", "where to send the verify payload, the url the provider delivers the webhook to")
+	acceptRejected := cmd.Flags().Bool("accept-rejected-deliveries", false, "accept that deliveries are rejected while the provider and the webhook use different secrets")
+
+	cmd.MarkFlagsRequiredTogether("verify-payload", "url")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if !*acceptRejected {
+			return fmt.Errorf("ingress webhooks have a single secret, deliveries are rejected while the provider and the webhook use different secrets. pass --accept-rejected-deliveries to rotate anyway")
+		}
+
+		id, err := klev.ParseIngressWebhookID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		webhook, err := klient.IngressWebhooks.Get(cmd.Context(), id)
+		if err != nil {
+			return outputErr(err)
+		}
+
+		newSecret := *secret
+		if newSecret == "" {
+			if newSecret, err = generateSecret(); err != nil {
+				return outputErr(err)
+			}
+		}
+
+		var body []byte
+		if *verifyPayload != "" {
+			if body, err = os.ReadFile(*verifyPayload); err != nil {
+				return outputErr(err)
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "new secret for %s (%s): %s\n", webhook.WebhookID, webhook.Type, newSecret)
+		if cmd.Flags().Changed("wait") {
+			fmt.Fprintf(os.Stderr, "switching to the new secret in %s\n", *wait)
+
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer cancel()
+
+			select {
+			case <-time.After(*wait):
+			case <-ctx.Done():
+				return fmt.Errorf("interrupted, webhook %s still uses the old secret", webhook.WebhookID)
+			}
+		} else {
+			ok, err := confirm("update the provider configuration, then switch to the new secret?")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("webhook %s still uses the old secret", webhook.WebhookID)
+			}
+		}
+
+		webhook, err = klient.IngressWebhooks.UpdateRaw(cmd.Context(), id, klev.IngressWebhookUpdateParams{Secret: &newSecret})
+		if err != nil {
+			return outputErr(err)
+		}
+
+		out := IngressRotateOut{IngressWebhookSecretOut: IngressWebhookSecretOut{webhook, newSecret}}
+		if body != nil {
+			verify, err := sendIngress(cmd.Context(), webhook, newSecret, *event, body, *url, 0, klev.MessageEncodingString)
+			if err != nil {
+				return outputErr(err)
+			}
+			out.Verify = &verify
+		}
+		return outputValue(out)
+	}
+
+	return cmd
+}
+
+// generateSecret creates a random 256 bit secret
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
 	"github.com/klev-dev/klev-api-go"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 func logsRoot() *cobra.Command {
@@ -86,20 +93,110 @@ func logsGet() *cobra.Command {
 }
 
 func logsStats() *cobra.Command {
-	return &cobra.Command{
-		Use:   "stats <log-id>",
+	cmd := &cobra.Command{
+		Use:   "stats <log-id>...",
 		Short: "stats a log",
-		Args:  cobra.ExactArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
-			id, err := klev.ParseLogID(args[0])
+		Args:  cobra.MinimumNArgs(1),
+	}
+
+	watch := cmd.Flags().Duration("watch", 0, "repeat every interval, showing rates")
+	format := cmd.Flags().String("format", "table", "watch output format: table or jsonl")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		var ids []klev.LogID
+		for _, arg := range args {
+			id, err := klev.ParseLogID(arg)
 			if err != nil {
 				return outputErr(err)
 			}
+			ids = append(ids, id)
+		}
 
-			out, err := klient.Logs.Stats(cmd.Context(), id)
+		if !cmd.Flags().Changed("watch") {
+			if len(ids) > 1 {
+				return fmt.Errorf("multiple logs require watch")
+			}
+			out, err := klient.Logs.Stats(cmd.Context(), ids[0])
 			return output(out, err)
-		},
+		}
+
+		if *format != "table" && *format != "jsonl" {
+			return fmt.Errorf("unknown format '%s'. Must be one of 'table, jsonl'", *format)
+		}
+		if *watch <= 0 {
+			return fmt.Errorf("watch must be positive")
+		}
+
+		prev := map[klev.LogID]LogStatsSample{}
+		ticker := time.NewTicker(*watch)
+		defer ticker.Stop()
+
+		for {
+			var samples []LogStatsSample
+			for _, id := range ids {
+				stats, err := klient.Logs.Stats(cmd.Context(), id)
+				if err != nil {
+					return outputErr(err)
+				}
+
+				sample := LogStatsSample{
+					Time:     time.Now().UTC(),
+					LogID:    id,
+					LogStats: stats,
+				}
+				if p, ok := prev[id]; ok {
+					elapsed := sample.Time.Sub(p.Time).Seconds()
+					sample.MessagesRate = float64(stats.Count-p.Count) / elapsed
+					sample.BytesRate = float64(stats.Size-p.Size) / elapsed
+				}
+				prev[id] = sample
+				samples = append(samples, sample)
+			}
+
+			if *format == "jsonl" {
+				enc := json.NewEncoder(os.Stdout)
+				for _, sample := range samples {
+					if err := enc.Encode(sample); err != nil {
+						return err
+					}
+				}
+			} else {
+				outputStatsTable(samples)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-cmd.Context().Done():
+				return nil
+			}
+		}
+	}
+
+	return cmd
+}
+
+// LogStatsSample is a log stats, together with rates since the previous sample
+type LogStatsSample struct {
+	Time  time.Time  `json:"time"`
+	LogID klev.LogID `json:"log_id"`
+	klev.LogStats
+	MessagesRate float64 `json:"messages_per_sec"`
+	BytesRate    float64 `json:"bytes_per_sec"`
+}
+
+func outputStatsTable(samples []LogStatsSample) {
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		// clear the terminal, so the table refreshes in place
+		fmt.Print("\033[H\033[2J")
+	}
+	fmt.Println(time.Now().Format(time.RFC3339))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "LOG\tCOUNT\tSIZE\tMSG/S\tBYTES/S\t")
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%.1f\t\n", s.LogID, s.Count, s.Size, s.MessagesRate, s.BytesRate)
 	}
+	w.Flush()
 }
 
 func logsUpdate() *cobra.Command {
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -13,10 +16,20 @@ import (
 )
 
 var klient *clients.Clients
+var baseURL string
+
+// stdin is shared, so buffered input isn't lost between reads
+var stdin = bufio.NewReader(os.Stdin)
+
+// auth is the token used by klient, authSource tells where it came from
+var auth, authSource string
 
 func main() {
 	rootCmd := root()
 	rootCmd.AddCommand(paths())
+	rootCmd.AddCommand(whoami())
+	rootCmd.AddCommand(login())
+	rootCmd.AddCommand(logout())
 	rootCmd.AddCommand(publish())
 	rootCmd.AddCommand(consume())
 	rootCmd.AddCommand(getByOffset())
@@ -28,46 +41,103 @@ func main() {
 	rootCmd.AddCommand(ingressWebhooksRoot())
 	rootCmd.AddCommand(egressWebhooksRoot())
 	rootCmd.AddCommand(filtersRoot())
-
-	if err := rootCmd.Execute(); err != nil {
+	rootCmd.AddCommand(check())
+	rootCmd.AddCommand(exporter())
+	rootCmd.AddCommand(benchRoot())
+	rootCmd.AddCommand(probe())
+	rootCmd.AddCommand(publishTail())
+	rootCmd.AddCommand(syslogServer())
+	rootCmd.AddCommand(httpIngest())
+	rootCmd.AddCommand(streamGateway())
+	rootCmd.AddCommand(sinkRoot())
+	rootCmd.AddCommand(sourceRoot())
+	rootCmd.AddCommand(bridgeRoot())
+
+	if cmd, err := rootCmd.ExecuteC(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		code := 1
+		if v, ok := cmd.Annotations[exitCodeAnnotation]; ok {
+			code, _ = strconv.Atoi(v)
+		}
+		os.Exit(code)
 	}
 }
 
+// exitCodeAnnotation sets the exit code of a command when it fails, instead of 1
+const exitCodeAnnotation = "exit-code"
+
 func root() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "klev",
 		Short: "cli to interact with klev",
 	}
 
-	authtoken := cmd.PersistentFlags().String("authtoken", "", "token to use for authorization")
-	base := cmd.PersistentFlags().String("base-url", "", "base url to talk to")
+	cmd.PersistentFlags().String("authtoken", "", "token to use for authorization")
+	cmd.PersistentFlags().String("authtoken-file", "", "file to read the authorization token from")
+	cmd.PersistentFlags().String("authtoken-cmd", "", "command that outputs the authorization token")
+	cmd.PersistentFlags().String("base-url", "", "base url to talk to")
 	cmd.PersistentFlags().MarkHidden("base-url")
 
+	cmd.MarkFlagsMutuallyExclusive("authtoken", "authtoken-file", "authtoken-cmd")
+
 	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
-		var auth string
-		if token := *authtoken; token != "" {
-			auth = token
-		} else if token := os.Getenv("KLEV_TOKEN"); token != "" {
-			auth = token
-		} else {
-			return fmt.Errorf("authtoken is missing. pass with with '--authtoken' or via KLEV_TOKEN env variable. get it from https://dash.klev.dev")
-		}
+		resolveBaseURL(cmd)
 
-		cfg := klev.NewConfig(auth)
-		if cmd.Flags().Changed("base-url") {
-			cfg.BaseURL = *base
-		} else if base := os.Getenv("KLEV_URL"); base != "" {
-			cfg.BaseURL = base
+		var err error
+		auth, authSource, err = givenToken(cmd)
+		if err == nil && auth == "" {
+			auth, authSource, err = loadLogin()
 		}
-		klient = clients.New(cfg)
+		if err != nil {
+			return err
+		}
+
+		klient = newKlient(auth)
 		return nil
 	}
 
 	return cmd
 }
 
+// givenToken reads the token from '--authtoken', '--authtoken-file', '--authtoken-cmd'
+// or KLEV_TOKEN env variable, returning an empty token when none is given
+func givenToken(cmd *cobra.Command) (string, string, error) {
+	flags := cmd.Flags()
+	if token, _ := flags.GetString("authtoken"); token != "" {
+		return token, "flag", nil
+	}
+	if path, _ := flags.GetString("authtoken-file"); path != "" {
+		token, err := readTokenFile(path)
+		return token, "file", err
+	}
+	if command, _ := flags.GetString("authtoken-cmd"); command != "" {
+		token, err := runTokenCmd(cmd.Context(), command)
+		return token, "cmd", err
+	}
+	if token := os.Getenv("KLEV_TOKEN"); token != "" {
+		return token, "env", nil
+	}
+	return "", "", nil
+}
+
+// resolveBaseURL sets the base url from '--base-url' or KLEV_URL env variable
+func resolveBaseURL(cmd *cobra.Command) {
+	if f := cmd.Flags().Lookup("base-url"); f != nil && f.Changed {
+		baseURL = f.Value.String()
+	} else if base := os.Getenv("KLEV_URL"); base != "" {
+		baseURL = base
+	}
+}
+
+// newKlient creates clients for a token, talking to the configured base url
+func newKlient(token string) *clients.Clients {
+	cfg := klev.NewConfig(token)
+	if baseURL != "" {
+		cfg.BaseURL = baseURL
+	}
+	return clients.New(cfg)
+}
+
 func paths() *cobra.Command {
 	return &cobra.Command{
 		Use:   "paths",
@@ -79,6 +149,23 @@ func paths() *cobra.Command {
 	}
 }
 
+// confirm asks a yes/no question on the terminal, defaulting to no
+func confirm(question string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+
+	answer, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
 func output(v any, err error) error {
 	if err != nil {
 		return outputErr(err)
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -134,19 +140,10 @@ func consume() *cobra.Command {
 				return outputErr(err)
 			}
 
-			var msgs = make([]klev.ConsumeMessageOut, len(out))
-			for i, m := range out {
-				msgs[i] = klev.ConsumeMessageOut{
-					Offset: m.Offset,
-					Time:   coder.EncodeTime(m.Time),
-					Key:    coder.EncodeData(m.Key),
-					Value:  coder.EncodeData(m.Value),
-				}
-			}
 			if err := output(klev.ConsumeOut{
 				NextOffset: next,
 				Encoding:   coder,
-				Messages:   msgs,
+				Messages:   encodeMessages(coder, out),
 			}, err); err != nil {
 				return outputErr(err)
 			}
@@ -191,18 +188,40 @@ func getByOffset() *cobra.Command {
 			return outputErr(err)
 		}
 
-		outMessage := klev.ConsumeMessageOut{
-			Offset: msg.Offset,
-			Time:   coder.EncodeTime(msg.Time),
-			Key:    coder.EncodeData(msg.Key),
-			Value:  coder.EncodeData(msg.Value),
-		}
-
-		return outputValue(outMessage)
+		return outputValue(encodeMessage(coder, msg))
 	}
 
 	return cmd
 }
+
+func encodeMessage(coder klev.MessageEncoding, m klev.ConsumeMessage) klev.ConsumeMessageOut {
+	return klev.ConsumeMessageOut{
+		Offset: m.Offset,
+		Time:   coder.EncodeTime(m.Time),
+		Key:    coder.EncodeData(m.Key),
+		Value:  coder.EncodeData(m.Value),
+	}
+}
+
+// encodeGetOut encodes a message the way klev delivers it to webhooks
+func encodeGetOut(m klev.ConsumeMessage) klev.GetOut {
+	coder := klev.MessageEncodingBase64
+	return klev.GetOut{
+		Encoding: coder,
+		Offset:   m.Offset,
+		Time:     coder.EncodeTime(m.Time),
+		Key:      coder.EncodeData(m.Key),
+		Value:    coder.EncodeData(m.Value),
+	}
+}
+
+func encodeMessages(coder klev.MessageEncoding, ms []klev.ConsumeMessage) []klev.ConsumeMessageOut {
+	var out = make([]klev.ConsumeMessageOut, len(ms))
+	for i, m := range ms {
+		out[i] = encodeMessage(coder, m)
+	}
+	return out
+}
 func receive() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "receive",
@@ -210,25 +229,129 @@ func receive() *cobra.Command {
 		Args:  cobra.NoArgs,
 	}
 
+	listen := cmd.Flags().String("listen", ":9000", "address to listen on")
 	secret := cmd.Flags().String("secret", "", "secret to validate the payload")
+	forwardLog := cmd.Flags().String("forward-log", "", "log id to publish received messages to")
+	forwardURL := cmd.Flags().String("forward-url", "", "url to forward received messages to")
+	queueDir := cmd.Flags().String("queue-dir", "", "directory to queue messages for forward-url (defaults to the user cache dir)")
+	queueSize := cmd.Flags().Int("queue-size", 10000, "max number of messages waiting for forward-url")
 	cmd.MarkFlagRequired("secret")
 
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		// authtoken is only needed to publish to a log
+		if cmd.Flags().Changed("forward-log") {
+			return cmd.Root().PersistentPreRunE(cmd, args)
+		}
+		return nil
+	}
+
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		var forwardLogID klev.LogID
+		if cmd.Flags().Changed("forward-log") {
+			id, err := klev.ParseLogID(*forwardLog)
+			if err != nil {
+				return outputErr(err)
+			}
+			forwardLogID = id
+		}
+
+		var queue *diskQueue
+		if *forwardURL != "" {
+			dir := *queueDir
+			if dir == "" {
+				cache, err := os.UserCacheDir()
+				if err != nil {
+					return err
+				}
+				dir = filepath.Join(cache, "klev", "receive-queue")
+			}
+
+			var err error
+			if queue, err = openDiskQueue(dir, *queueSize); err != nil {
+				return err
+			}
+			go func() {
+				err := queue.Run(cmd.Context(), forwardRetriable, func(b []byte) error {
+					return forwardMessage(cmd.Context(), *forwardURL, b)
+				})
+				fmt.Fprintf(os.Stderr, "forwarding stopped: %v\n", err)
+			}()
+		}
+
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			msg, err := ingress_validate.Message(w, r, time.Now, *secret)
 			if err != nil {
-				outputErr(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				fmt.Fprintln(os.Stderr, err)
+				return
 			}
 			fmt.Printf("Offset: %d\n Time: %v\n Key: %s\n Value: %s\n",
 				msg.Offset, msg.Time, msg.Key, msg.Value)
+
+			if queue != nil {
+				b, err := json.Marshal(encodeGetOut(msg))
+				if err == nil {
+					err = queue.Push(b)
+				}
+				if err != nil {
+					// klev will retry the delivery, hopefully when the queue has space
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					fmt.Fprintln(os.Stderr, err)
+					return
+				}
+			}
+
+			// published last, so a rejected delivery isn't published again when klev retries it
+			if forwardLogID != (klev.LogID{}) {
+				if _, err := klient.Messages.Post(r.Context(), forwardLogID, msg.Time, msg.Key, msg.Value); err != nil {
+					// klev will retry the delivery, forward-url may get it twice
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					fmt.Fprintln(os.Stderr, err)
+					return
+				}
+			}
 		})
-		fmt.Println("running server at :9000")
-		return http.ListenAndServe(":9000", nil)
+		fmt.Printf("running server at %s\n", *listen)
+		return http.ListenAndServe(*listen, nil)
 	}
 
 	return cmd
 }
 
+// errForwardRejected is returned when forward-url responds with a client error,
+// which won't change when the message is sent again
+var errForwardRejected = errors.New("rejected")
+
+func forwardRetriable(err error) bool {
+	return !errors.Is(err, errForwardRejected)
+}
+
+// forwardMessage posts a json encoded message to url, expecting a 2xx response
+func forwardMessage(ctx context.Context, url string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("forward to %s %w: %s", url, errForwardRejected, resp.Status)
+	default:
+		return fmt.Errorf("forward to %s failed: %s", url, resp.Status)
+	}
+}
+
 func cleanup() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "cleanup",
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+// ProbeOut is the result of a probe run
+type ProbeOut struct {
+	ProbeID       string       `json:"probe_id"`
+	LogID         klev.LogID   `json:"log_id"`
+	Mode          string       `json:"mode"`
+	Target        string       `json:"target"`
+	Sent          int          `json:"sent"`
+	Received      int          `json:"received"`
+	Lost          int          `json:"lost"`
+	Loss          float64      `json:"loss"`
+	Duplicates    int          `json:"duplicates"`
+	PublishErrors int          `json:"publish_errors"`
+	Latency       BenchLatency `json:"latency_ms"`
+	Missing       []int        `json:"missing,omitempty"`
+	LastError     string       `json:"last_error,omitempty"`
+}
+
+// probeCanary is the value of each published probe message
+type probeCanary struct {
+	Probe string    `json:"probe"`
+	Seq   int       `json:"seq"`
+	Sent  time.Time `json:"sent"`
+}
+
+func probe() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "probe <log-id>",
+		Short: "measure end-to-end latency from publishing to a filter target log or an egress webhook",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	targetLog := cmd.Flags().String("target-log", "", "log to watch for the canaries, like a filter's target. defaults to the published log")
+	listen := cmd.Flags().String("listen", "", "address to receive egress webhook deliveries on, instead of watching a log")
+	secret := cmd.Flags().String("secret", "", "egress webhook secret, to validate deliveries")
+	count := cmd.Flags().Int("count", 10, "number of canary messages to publish")
+	interval := cmd.Flags().Duration("interval", time.Second, "time between canary messages")
+	timeout := cmd.Flags().Duration("timeout", 30*time.Second, "how long to wait for canaries after the last is published")
+	key := cmd.Flags().String("key", "klev-probe", "key of the canary messages")
+	poll := cmd.Flags().Duration("poll", 10*time.Second, "how long to wait for new messages in the target log")
+
+	cmd.MarkFlagsMutuallyExclusive("target-log", "listen")
+	cmd.MarkFlagsRequiredTogether("listen", "secret")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseLogID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+		if *count <= 0 {
+			return fmt.Errorf("count must be positive")
+		}
+
+		probeID, err := newProbeID()
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+
+		tracker := newProbeTracker(probeID)
+		out := ProbeOut{ProbeID: probeID, LogID: id}
+
+		// start watching before publishing anything, so no canary is missed
+		if *listen != "" {
+			out.Mode, out.Target = "egress-webhook", *listen
+
+			srv, err := listenProbeEgress(*listen, *secret, tracker)
+			if err != nil {
+				return err
+			}
+			defer srv.Close()
+		} else {
+			target := id
+			if *targetLog != "" {
+				if target, err = klev.ParseLogID(*targetLog); err != nil {
+					return outputErr(err)
+				}
+			}
+			out.Mode, out.Target = "log", target.String()
+
+			next, _, err := klient.Messages.Consume(ctx, target, klev.ConsumeNewest(), klev.ConsumeLen(1))
+			if err != nil {
+				return outputErr(err)
+			}
+			go watchProbeLog(ctx, target, next, *poll, tracker)
+		}
+
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for seq := 0; seq < *count; seq++ {
+			if seq > 0 {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			canary := probeCanary{Probe: probeID, Seq: seq, Sent: time.Now().UTC()}
+			value, err := json.Marshal(canary)
+			if err != nil {
+				return err
+			}
+			if _, err := klient.Messages.Post(ctx, id, time.Time{}, []byte(*key), value); err != nil {
+				out.PublishErrors++
+				tracker.fail(err)
+				continue
+			}
+			tracker.sent(seq)
+		}
+
+		tracker.wait(ctx, *timeout)
+		tracker.summarize(&out)
+		return outputValue(out)
+	}
+
+	return cmd
+}
+
+func newProbeID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// probeTracker matches received canaries to the published ones
+type probeTracker struct {
+	id string
+
+	mu         sync.Mutex
+	published  map[int]bool
+	received   map[int]time.Duration
+	duplicates int
+	lastError  error
+
+	changed chan struct{}
+}
+
+func newProbeTracker(id string) *probeTracker {
+	return &probeTracker{
+		id:        id,
+		published: map[int]bool{},
+		received:  map[int]time.Duration{},
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+func (t *probeTracker) sent(seq int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.published[seq] = true
+}
+
+func (t *probeTracker) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastError = err
+}
+
+// observe records a received value, ignoring anything that isn't a canary of this probe
+func (t *probeTracker) observe(value []byte, at time.Time) {
+	var canary probeCanary
+	if err := json.Unmarshal(value, &canary); err != nil || canary.Probe != t.id {
+		return
+	}
+
+	t.mu.Lock()
+	if _, ok := t.received[canary.Seq]; ok {
+		t.duplicates++
+	} else {
+		t.received[canary.Seq] = at.Sub(canary.Sent)
+	}
+	t.mu.Unlock()
+
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (t *probeTracker) complete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for seq := range t.published {
+		if _, ok := t.received[seq]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// wait until all published canaries are received, or the timeout expires
+func (t *probeTracker) wait(ctx context.Context, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !t.complete() {
+		select {
+		case <-t.changed:
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *probeTracker) summarize(out *ProbeOut) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var latencies []time.Duration
+	for seq := range t.published {
+		if latency, ok := t.received[seq]; ok {
+			latencies = append(latencies, latency)
+		} else {
+			out.Missing = append(out.Missing, seq)
+		}
+	}
+	sort.Ints(out.Missing)
+
+	out.Sent = len(t.published)
+	out.Received = len(latencies)
+	out.Lost = len(out.Missing)
+	if out.Sent > 0 {
+		out.Loss = float64(out.Lost) / float64(out.Sent)
+	}
+	out.Duplicates = t.duplicates
+	out.Latency = latencyPercentiles(latencies)
+	if t.lastError != nil {
+		out.LastError = t.lastError.Error()
+	}
+}
+
+// watchProbeLog consumes the target log from offset, until the context is done
+func watchProbeLog(ctx context.Context, id klev.LogID, offset int64, poll time.Duration, t *probeTracker) {
+	for ctx.Err() == nil {
+		err := retryIf(ctx, klevRetriable, func() error {
+			next, msgs, err := klient.Messages.Consume(ctx, id, klev.ConsumeOffset(offset), klev.ConsumePoll(poll))
+			switch {
+			case ctx.Err() != nil:
+				// the probe is done
+				return nil
+			case err != nil:
+				t.fail(err)
+				return err
+			}
+
+			now := time.Now()
+			for _, m := range msgs {
+				t.observe(m.Value, now)
+			}
+			offset = next
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// listenProbeEgress starts a server receiving egress webhook deliveries of the canaries
+func listenProbeEgress(addr string, secret string, t *probeTracker) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := []egressSecret{{"current", secret}}
+	srv := &http.Server{
+		// canaries are in the message value
+		Handler: egressDeliveryHandler(secrets, klev.MessageEncodingString, klev.EgressWebhookPayloadValue, func(out EgressDeliveryOut) int {
+			switch {
+			case out.Message != nil && out.Message.Value != nil:
+				t.observe([]byte(*out.Message.Value), out.Time)
+			case out.Value != nil:
+				t.observe([]byte(*out.Value), out.Time)
+			}
+			return http.StatusOK
+		}),
+	}
+
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.fail(err)
+		}
+	}()
+	return srv, nil
+}
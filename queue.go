@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+var errQueueFull = errors.New("queue is full")
+
+// diskQueue is a bounded fifo queue, storing each entry as a file in a directory,
+// so entries survive restarts
+type diskQueue struct {
+	dir        string
+	max        int
+	deadLetter string
+
+	mu     sync.Mutex
+	size   int
+	next   uint64
+	notify chan struct{}
+}
+
+func openDiskQueue(dir string, max int) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	names, err := queueEntries(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{
+		dir:        dir,
+		max:        max,
+		deadLetter: filepath.Join(dir, "dead-letter.jsonl"),
+		size:       len(names),
+		notify:     make(chan struct{}, 1),
+	}
+	if len(names) > 0 {
+		last, err := strconv.ParseUint(strings.TrimSuffix(names[len(names)-1], ".msg"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		q.next = last + 1
+	}
+	return q, nil
+}
+
+// Push adds an entry at the end of the queue, failing when the queue is full
+func (q *diskQueue) Push(b []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size >= q.max {
+		return errQueueFull
+	}
+
+	name := filepath.Join(q.dir, fmt.Sprintf("%020d.msg", q.next))
+	if err := os.WriteFile(name+".tmp", b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	q.next++
+	q.size++
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run passes entries, in order, to fn. An entry is removed once fn succeeds,
+// otherwise fn is retried with a backoff until the context is done. Entries fn
+// fails with an error that isn't retriable are moved to the dead letter file
+func (q *diskQueue) Run(ctx context.Context, retriable func(error) bool, fn func([]byte) error) error {
+	for {
+		names, err := queueEntries(q.dir)
+		if err != nil {
+			return err
+		}
+
+		if len(names) == 0 {
+			select {
+			case <-q.notify:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		for _, name := range names {
+			path := filepath.Join(q.dir, name)
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			if err := retryIf(ctx, retriable, func() error { return fn(b) }); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				if err := q.bury(b); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "dropped %s, moved to %s: %v\n", name, q.deadLetter, err)
+			}
+
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			q.mu.Lock()
+			q.size--
+			q.mu.Unlock()
+		}
+	}
+}
+
+// bury appends an entry to the dead letter file, one entry per line
+func (q *diskQueue) bury(b []byte) error {
+	f, err := os.OpenFile(q.deadLetter, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// retry calls fn until it succeeds, with exponential backoff up to a minute
+func retry(ctx context.Context, fn func() error) error {
+	return retryIf(ctx, func(error) bool { return true }, fn)
+}
+
+// retryIf calls fn until it succeeds, or fails with an error that isn't retriable
+func retryIf(ctx context.Context, retriable func(error) bool, fn func() error) error {
+	backoff := time.Second
+	for {
+		err := fn()
+		switch {
+		case err == nil:
+			return nil
+		case ctx.Err() != nil:
+			// interrupted, there won't be a retry
+			return ctx.Err()
+		case !retriable(err):
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "retrying in %s: %v\n", backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// klevRetriable is false for errors klev responds with, as the same request fails
+// the same way again, unless the server itself is failing
+func klevRetriable(err error) bool {
+	if klev.GetError(err) == nil {
+		return true
+	}
+	return klev.IsError(err, klev.ErrServerErrorCode) || klev.IsError(err, klev.ErrMaintenanceErrorCode)
+}
+
+func queueEntries(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".msg") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
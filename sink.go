@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func sinkRoot() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sink",
+		Short: "write consumed messages to external storage",
+	}
+
+	cmd.AddCommand(sinkSQLite())
+	cmd.AddCommand(sinkFiles())
+	cmd.AddCommand(sinkS3())
+
+	return cmd
+}
+
+// SinkOut describes messages written by a sink
+type SinkOut struct {
+	LogID      klev.LogID `json:"log_id"`
+	Messages   int64      `json:"messages"`
+	NextOffset int64      `json:"next_offset"`
+}
+
+// sinkConsume consumes the log from offset, calling write with each batch.
+// it stops when caught up, or when following, once the context is done.
+// when following, consume errors are retried unless klev rejects the request, and write is also called
+// without messages after each poll, so sinks can flush on time
+func sinkConsume(ctx context.Context, id klev.LogID, offset int64, size int32, follow bool, poll time.Duration,
+	write func(msgs []klev.ConsumeMessage, next int64) error) (SinkOut, error) {
+
+	out := SinkOut{LogID: id, NextOffset: offset}
+	opts := []klev.ConsumeOpt{klev.ConsumeOffset(offset), klev.ConsumeLen(size)}
+	if follow {
+		opts = append(opts, klev.ConsumePoll(poll))
+	}
+
+	for {
+		var next int64
+		var msgs []klev.ConsumeMessage
+		consume := func() error {
+			var err error
+			next, msgs, err = klient.Messages.Consume(ctx, id, opts...)
+			return err
+		}
+
+		var err error
+		if follow {
+			err = retryIf(ctx, klevRetriable, consume)
+		} else {
+			err = consume()
+		}
+		switch {
+		case follow && ctx.Err() != nil:
+			return out, nil
+		case err != nil:
+			return out, err
+		}
+
+		if len(msgs) > 0 || follow {
+			if err := write(msgs, next); err != nil {
+				return out, err
+			}
+			out.Messages += int64(len(msgs))
+		}
+		out.NextOffset = next
+		opts[0] = klev.ConsumeOffset(next)
+
+		if len(msgs) == 0 && !follow {
+			return out, nil
+		}
+	}
+}
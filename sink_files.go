@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/cobra"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func sinkFiles() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "files <log-id>",
+		Short: "write consumed messages to rotated local files",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	dir := cmd.Flags().String("dir", "", "directory to write files and the manifest to")
+	format := cmd.Flags().String("format", "jsonl", "file format: jsonl or parquet")
+	compress := cmd.Flags().String("compress", "none", "compression: none or zstd")
+	encoding := cmd.Flags().String("encoding", "base64", "how to convert message payload in jsonl files")
+	partition := cmd.Flags().String("partition", "2006/01/02/15", "go time layout of the subdirectory for messages, by their time in UTC")
+	rotateSize := cmd.Flags().String("rotate-size", "100MB", "start a new file after this much message data")
+	rotateInterval := cmd.Flags().Duration("rotate-interval", time.Hour, "start a new file after this long")
+	offset := cmd.Flags().Int64("offset", klev.OffsetOldest, "the starting offset, when the manifest has no progress")
+	size := cmd.Flags().Int32("size", 100, "max messages to consume at once")
+	follow := cmd.Flags().Bool("follow", false, "keep waiting for new messages, until interrupted")
+	poll := cmd.Flags().Duration("poll", 10*time.Second, "how long to wait for new messages when following")
+
+	cmd.MarkFlagRequired("dir")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseLogID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		s := &fileSink{
+			logID:          id,
+			dir:            *dir,
+			format:         *format,
+			compress:       *compress,
+			partition:      *partition,
+			rotateInterval: *rotateInterval,
+		}
+		if s.coder, err = klev.ParseMessageEncoding(*encoding); err != nil {
+			return outputErr(err)
+		}
+		if s.format != "jsonl" && s.format != "parquet" {
+			return fmt.Errorf("unknown format '%s'. Must be one of 'jsonl, parquet'", s.format)
+		}
+		if s.compress != "none" && s.compress != "zstd" {
+			return fmt.Errorf("unknown compression '%s'. Must be one of 'none, zstd'", s.compress)
+		}
+		if s.rotateSize, err = parseByteSize(*rotateSize); err != nil {
+			return err
+		}
+
+		if err := s.open(); err != nil {
+			return err
+		}
+		start := *offset
+		if s.manifest.NextOffset != nil {
+			start = *s.manifest.NextOffset
+		}
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		out, err := sinkConsume(ctx, id, start, *size, *follow, *poll, s.write)
+		if err == nil {
+			// messages already consumed are kept
+			err = s.rotate(out.NextOffset)
+		}
+		if err != nil {
+			return outputErr(err)
+		}
+		return outputValue(out)
+	}
+
+	return cmd
+}
+
+// FilesManifest lists the completed files of a sink, and the next offset to consume.
+// files cover consecutive offsets, without gaps
+type FilesManifest struct {
+	LogID      klev.LogID           `json:"log_id"`
+	Format     string               `json:"format"`
+	Compress   string               `json:"compress"`
+	Encoding   klev.MessageEncoding `json:"encoding,omitempty"`
+	NextOffset *int64               `json:"next_offset"`
+	Files      []FilesManifestEntry `json:"files"`
+}
+
+// FilesManifestEntry describes a completed file
+type FilesManifestEntry struct {
+	Path        string    `json:"path"`
+	FirstOffset int64     `json:"first_offset"`
+	LastOffset  int64     `json:"last_offset"`
+	Messages    int64     `json:"messages"`
+	Size        int64     `json:"size"`
+	MinTime     time.Time `json:"min_time"`
+	MaxTime     time.Time `json:"max_time"`
+}
+
+// fileSink writes messages to a file in the current partition, which is moved
+// to its final name, and recorded in the manifest, when rotated
+type fileSink struct {
+	logID          klev.LogID
+	dir            string
+	format         string
+	compress       string
+	coder          klev.MessageEncoding
+	partition      string
+	rotateSize     int64
+	rotateInterval time.Duration
+
+	manifest FilesManifest
+	current  *sinkFile
+}
+
+func (s *fileSink) manifestPath() string {
+	return filepath.Join(s.dir, "manifest.json")
+}
+
+// open reads the manifest, and removes files not recorded in it. those were
+// interrupted before completing, and their messages will be consumed again
+func (s *fileSink) open() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(s.manifestPath())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		s.manifest = FilesManifest{LogID: s.logID, Format: s.format, Compress: s.compress, Files: []FilesManifestEntry{}}
+		if s.format == "jsonl" {
+			s.manifest.Encoding = s.coder
+		}
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(b, &s.manifest); err != nil {
+			return fmt.Errorf("invalid manifest %s: %w", s.manifestPath(), err)
+		}
+		if s.manifest.LogID != s.logID {
+			return fmt.Errorf("%s is a sink of log %s", s.dir, s.manifest.LogID)
+		}
+		if s.manifest.Format != s.format || s.manifest.Compress != s.compress {
+			return fmt.Errorf("%s has %s files with %s compression", s.dir, s.manifest.Format, s.manifest.Compress)
+		}
+	}
+
+	known := map[string]bool{}
+	for _, f := range s.manifest.Files {
+		known[f.Path] = true
+	}
+	return filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if known[rel] || !strings.HasPrefix(d.Name(), s.logID.String()+"-") {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "removing incomplete %s\n", path)
+		return os.Remove(path)
+	})
+}
+
+// write adds messages to the current file, rotating it when needed.
+// it is also called without messages, to rotate on time
+func (s *fileSink) write(msgs []klev.ConsumeMessage, next int64) error {
+	for i, m := range msgs {
+		partition := m.Time.UTC().Format(s.partition)
+		if s.current != nil && s.current.partition != partition {
+			if err := s.rotate(m.Offset); err != nil {
+				return err
+			}
+		}
+		if s.current == nil {
+			f, err := s.create(partition, m)
+			if err != nil {
+				return err
+			}
+			s.current = f
+		}
+
+		if err := s.current.write(m); err != nil {
+			return err
+		}
+		if s.current.dataSize >= s.rotateSize {
+			after := next
+			if i+1 < len(msgs) {
+				after = msgs[i+1].Offset
+			}
+			if err := s.rotate(after); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.current != nil && time.Since(s.current.created) >= s.rotateInterval {
+		return s.rotate(next)
+	}
+	return nil
+}
+
+func (s *fileSink) create(partition string, first klev.ConsumeMessage) (*sinkFile, error) {
+	dir := filepath.Join(s.dir, filepath.FromSlash(partition))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(dir, s.logID.String()+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	sf := &sinkFile{
+		partition: partition,
+		tmp:       f,
+		created:   time.Now(),
+		first:     first.Offset,
+		minTime:   first.Time,
+		maxTime:   first.Time,
+		coder:     s.coder,
+	}
+	sf.buf = bufio.NewWriter(f)
+
+	var w io.Writer = sf.buf
+	if s.format == "jsonl" && s.compress == "zstd" {
+		if sf.zw, err = zstd.NewWriter(w); err != nil {
+			f.Close()
+			return nil, err
+		}
+		w = sf.zw
+	}
+
+	switch s.format {
+	case "jsonl":
+		sf.enc = json.NewEncoder(w)
+	case "parquet":
+		if sf.pw, err = writer.NewParquetWriterFromWriter(w, new(parquetMessage), 1); err != nil {
+			f.Close()
+			return nil, err
+		}
+		sf.pw.CompressionType = parquet.CompressionCodec_UNCOMPRESSED
+		if s.compress == "zstd" {
+			sf.pw.CompressionType = parquet.CompressionCodec_ZSTD
+		}
+	}
+	return sf, nil
+}
+
+// rotate completes the current file, moving it to its final name, then records it in the manifest,
+// with next as the offset to consume after it
+func (s *fileSink) rotate(next int64) error {
+	f := s.current
+	if f == nil {
+		return nil
+	}
+	s.current = nil
+
+	if err := f.close(); err != nil {
+		return err
+	}
+
+	ext := "." + s.format
+	if s.compress == "zstd" && s.format == "jsonl" {
+		ext += ".zst"
+	}
+	name := fmt.Sprintf("%s-%020d-%020d%s", s.logID, f.first, f.last, ext)
+	path := filepath.Join(filepath.Dir(f.tmp.Name()), name)
+	if err := os.Rename(f.tmp.Name(), path); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil {
+		return err
+	}
+	s.manifest.NextOffset = &next
+	s.manifest.Files = append(s.manifest.Files, FilesManifestEntry{
+		Path:        filepath.ToSlash(rel),
+		FirstOffset: f.first,
+		LastOffset:  f.last,
+		Messages:    f.messages,
+		Size:        info.Size(),
+		MinTime:     f.minTime.UTC(),
+		MaxTime:     f.maxTime.UTC(),
+	})
+
+	b, err := json.MarshalIndent(s.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.manifestPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.manifestPath())
+}
+
+// parquetMessage is the parquet schema of messages, keys and values are binary
+type parquetMessage struct {
+	Offset int64   `parquet:"name=offset, type=INT64"`
+	Time   int64   `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	Key    *string `parquet:"name=key, type=BYTE_ARRAY, repetitiontype=OPTIONAL"`
+	Value  *string `parquet:"name=value, type=BYTE_ARRAY, repetitiontype=OPTIONAL"`
+}
+
+// sinkFile is a file being written, under a temporary name
+type sinkFile struct {
+	partition string
+	tmp       *os.File
+	buf       *bufio.Writer
+	zw        *zstd.Encoder
+	enc       *json.Encoder
+	pw        *writer.ParquetWriter
+	coder     klev.MessageEncoding
+
+	created  time.Time
+	first    int64
+	last     int64
+	messages int64
+	dataSize int64
+	minTime  time.Time
+	maxTime  time.Time
+}
+
+func (f *sinkFile) write(m klev.ConsumeMessage) error {
+	if f.enc != nil {
+		if err := f.enc.Encode(encodeMessage(f.coder, m)); err != nil {
+			return err
+		}
+	} else {
+		pm := &parquetMessage{Offset: m.Offset, Time: m.Time.UnixMicro()}
+		if m.Key != nil {
+			key := string(m.Key)
+			pm.Key = &key
+		}
+		if m.Value != nil {
+			value := string(m.Value)
+			pm.Value = &value
+		}
+		if err := f.pw.Write(pm); err != nil {
+			return err
+		}
+	}
+
+	f.last = m.Offset
+	f.messages++
+	f.dataSize += int64(len(m.Key) + len(m.Value))
+	if m.Time.Before(f.minTime) {
+		f.minTime = m.Time
+	}
+	if m.Time.After(f.maxTime) {
+		f.maxTime = m.Time
+	}
+	return nil
+}
+
+// close flushes everything to disk
+func (f *sinkFile) close() error {
+	if f.pw != nil {
+		if err := f.pw.WriteStop(); err != nil {
+			return err
+		}
+	}
+	if f.zw != nil {
+		if err := f.zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	if err := f.tmp.Sync(); err != nil {
+		return err
+	}
+	return f.tmp.Close()
+}
+
+var byteSizeRegexp = regexp.MustCompile(`^(\d+)\s*([KMGT]?)(I?)B?$`)
+
+// parseByteSize parses sizes like 512KB, 100MB or 1GiB
+func parseByteSize(s string) (int64, error) {
+	m := byteSizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil || (m[2] == "" && m[3] != "") {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s': %w", s, err)
+	}
+
+	base := int64(1000)
+	if m[3] != "" {
+		base = 1024
+	}
+	for i := 0; i <= strings.Index("KMGT", m[2]) && m[2] != ""; i++ {
+		if n > math.MaxInt64/base {
+			return 0, fmt.Errorf("invalid size '%s': too large", s)
+		}
+		n *= base
+	}
+	return n, nil
+}
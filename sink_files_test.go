@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		size int64
+		err  bool
+	}{
+		{in: "0", size: 0},
+		{in: "512", size: 512},
+		{in: "512B", size: 512},
+		{in: "512KB", size: 512_000},
+		{in: "512kb", size: 512_000},
+		{in: "100MB", size: 100_000_000},
+		{in: "100M", size: 100_000_000},
+		{in: "2GB", size: 2_000_000_000},
+		{in: "1TB", size: 1_000_000_000_000},
+		{in: "1KiB", size: 1024},
+		{in: "1MiB", size: 1 << 20},
+		{in: "1GiB", size: 1 << 30},
+		{in: "1TiB", size: 1 << 40},
+		{in: " 64 MB ", size: 64_000_000},
+		{in: "8388607TiB", size: 8388607 << 40},
+		{in: "8388608TiB", err: true},
+		{in: "9223372036854775807", size: math.MaxInt64},
+		{in: "9223372036854775808", err: true},
+		{in: "9223372036854775807KB", err: true},
+		{in: "", err: true},
+		{in: "MB", err: true},
+		{in: "-1MB", err: true},
+		{in: "1.5GB", err: true},
+		{in: "1iB", err: true},
+		{in: "1PB", err: true},
+		{in: "1 MBs", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Quote(tt.in), func(t *testing.T) {
+			size, err := parseByteSize(tt.in)
+			switch {
+			case tt.err && err == nil:
+				t.Fatalf("expected an error, got %d", size)
+			case !tt.err && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case size != tt.size:
+				t.Fatalf("expected %d, got %d", tt.size, size)
+			}
+		})
+	}
+}
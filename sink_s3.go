@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func sinkS3() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "s3 <log-id>",
+		Short: "write consumed messages to objects in s3 compatible storage",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	store := addS3Flags(cmd)
+	compress := cmd.Flags().String("compress", "zstd", "compression: none or zstd")
+	encoding := cmd.Flags().String("encoding", "base64", "how to convert message payload in objects")
+	objectSize := cmd.Flags().String("object-size", "64MB", "start a new object after this much message data")
+	objectInterval := cmd.Flags().Duration("object-interval", 5*time.Minute, "start a new object after this long, when following")
+	offsetID := cmd.Flags().String("offset-id", "", "offset to checkpoint the next offset to archive in")
+	offset := cmd.Flags().Int64("offset", klev.OffsetOldest, "the starting offset, when there is no checkpoint or archived objects")
+	size := cmd.Flags().Int32("size", 100, "max messages to consume at once")
+	follow := cmd.Flags().Bool("follow", false, "keep waiting for new messages, until interrupted")
+	poll := cmd.Flags().Duration("poll", 10*time.Second, "how long to wait for new messages when following")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseLogID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		s := &s3Sink{
+			logID:          id,
+			bucket:         *store.bucket,
+			prefix:         s3LogPrefix(*store.prefix, id),
+			compress:       *compress,
+			objectInterval: *objectInterval,
+		}
+		if s.coder, err = klev.ParseMessageEncoding(*encoding); err != nil {
+			return outputErr(err)
+		}
+		if s.compress != "none" && s.compress != "zstd" {
+			return fmt.Errorf("unknown compression '%s'. Must be one of 'none, zstd'", s.compress)
+		}
+		if s.objectSize, err = parseByteSize(*objectSize); err != nil {
+			return err
+		}
+		if *offsetID != "" {
+			oid, err := klev.ParseOffsetID(*offsetID)
+			if err != nil {
+				return outputErr(err)
+			}
+			s.offsetID = &oid
+		}
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		if s.client, err = store.open(ctx); err != nil {
+			return err
+		}
+
+		start, err := s.progress(ctx, *offset)
+		if err != nil {
+			return outputErr(err)
+		}
+
+		out, err := sinkConsume(ctx, id, start, *size, *follow, *poll, s.write)
+		if err == nil {
+			// messages already consumed are kept
+			err = s.flush()
+		}
+		if err != nil {
+			return outputErr(err)
+		}
+		return outputValue(out)
+	}
+
+	return cmd
+}
+
+// s3Flags are the flags to connect to a bucket, shared by the s3 sink and source
+type s3Flags struct {
+	endpoint  *string
+	region    *string
+	accessKey *string
+	secretKey *string
+	bucket    *string
+	prefix    *string
+}
+
+func addS3Flags(cmd *cobra.Command) *s3Flags {
+	f := &s3Flags{
+		endpoint:  cmd.Flags().String("endpoint", "https://s3.amazonaws.com", "url of the s3 compatible storage, like http://localhost:9000 for minio"),
+		region:    cmd.Flags().String("region", "", "region of the bucket"),
+		accessKey: cmd.Flags().String("access-key", "", "access key, defaults to AWS_ACCESS_KEY_ID or MINIO_ACCESS_KEY"),
+		secretKey: cmd.Flags().String("secret-key", "", "secret key, defaults to AWS_SECRET_ACCESS_KEY or MINIO_SECRET_KEY"),
+		bucket:    cmd.Flags().String("bucket", "", "bucket of the objects"),
+		prefix:    cmd.Flags().String("prefix", "", "prefix of the object names, like archive/"),
+	}
+	cmd.MarkFlagRequired("bucket")
+	return f
+}
+
+// open connects to the storage, checking the bucket exists
+func (f *s3Flags) open(ctx context.Context) (*minio.Client, error) {
+	u, err := url.Parse(*f.endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint '%s'. Must be like 'https://host:port'", *f.endpoint)
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+	})
+	if *f.accessKey != "" || *f.secretKey != "" {
+		creds = credentials.NewStaticV4(*f.accessKey, *f.secretKey, "")
+	}
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  creds,
+		Secure: u.Scheme == "https",
+		Region: *f.region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(ctx, *f.bucket)
+	switch {
+	case err != nil:
+		return nil, err
+	case !exists:
+		return nil, fmt.Errorf("bucket '%s' not found", *f.bucket)
+	}
+	return client, nil
+}
+
+// s3LogPrefix is where the objects of a log are, each named by its offset range
+func s3LogPrefix(prefix string, id klev.LogID) string {
+	return prefix + id.String() + "/"
+}
+
+var s3ObjectRegexp = regexp.MustCompile(`^(\d{20})-(\d{20})\.jsonl(\.zst)?$`)
+
+// parseS3ObjectName returns the offset range of an object, and if it is compressed
+func parseS3ObjectName(name string) (first int64, last int64, zst bool, ok bool) {
+	m := s3ObjectRegexp.FindStringSubmatch(path.Base(name))
+	if m == nil {
+		return 0, 0, false, false
+	}
+	first, _ = strconv.ParseInt(m[1], 10, 64)
+	last, _ = strconv.ParseInt(m[2], 10, 64)
+	return first, last, m[3] != "", true
+}
+
+// s3Sink buffers messages in an object, uploaded when complete, and then
+// checkpoints the next offset to archive
+type s3Sink struct {
+	client         *minio.Client
+	bucket         string
+	prefix         string
+	logID          klev.LogID
+	compress       string
+	coder          klev.MessageEncoding
+	objectSize     int64
+	objectInterval time.Duration
+	offsetID       *klev.OffsetID
+
+	current *s3Object
+}
+
+// progress returns the offset to continue from: the checkpoint, unless there are
+// objects after it, uploaded before an interrupted run could checkpoint them
+func (s *s3Sink) progress(ctx context.Context, offset int64) (int64, error) {
+	if s.offsetID != nil {
+		o, err := klient.Offsets.Get(ctx, *s.offsetID)
+		if err != nil {
+			return 0, err
+		}
+		if o.LogID != s.logID {
+			return 0, fmt.Errorf("offset %s is for log %s", o.OffsetID, o.LogID)
+		}
+		if o.Value >= 0 {
+			offset = o.Value
+		}
+	}
+
+	opts := minio.ListObjectsOptions{Prefix: s.prefix, Recursive: true}
+	if offset >= 0 {
+		opts.StartAfter = fmt.Sprintf("%s%020d", s.prefix, offset)
+	}
+	for obj := range s.client.ListObjects(ctx, s.bucket, opts) {
+		if obj.Err != nil {
+			return 0, obj.Err
+		}
+		if _, last, _, ok := parseS3ObjectName(obj.Key); ok && last >= offset {
+			offset = last + 1
+		}
+	}
+	return offset, nil
+}
+
+// write adds messages to the current object, uploading it when needed.
+// it is also called without messages, to upload on time
+func (s *s3Sink) write(msgs []klev.ConsumeMessage, next int64) error {
+	for _, m := range msgs {
+		if s.current == nil {
+			obj, err := s.create(m)
+			if err != nil {
+				return err
+			}
+			s.current = obj
+		}
+
+		if err := s.current.write(m); err != nil {
+			return err
+		}
+		if s.current.dataSize >= s.objectSize {
+			if err := s.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.current != nil && time.Since(s.current.created) >= s.objectInterval {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *s3Sink) create(first klev.ConsumeMessage) (*s3Object, error) {
+	obj := &s3Object{created: time.Now(), first: first.Offset, coder: s.coder}
+	if s.compress == "zstd" {
+		zw, err := zstd.NewWriter(&obj.buf)
+		if err != nil {
+			return nil, err
+		}
+		obj.zw = zw
+		obj.enc = json.NewEncoder(zw)
+	} else {
+		obj.enc = json.NewEncoder(&obj.buf)
+	}
+	return obj, nil
+}
+
+// flush uploads the current object, then checkpoints the offset after it
+func (s *s3Sink) flush() error {
+	obj := s.current
+	if obj == nil {
+		return nil
+	}
+	s.current = nil
+
+	if obj.zw != nil {
+		if err := obj.zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	name := fmt.Sprintf("%s%020d-%020d.jsonl", s.prefix, obj.first, obj.last)
+	if obj.zw != nil {
+		name += ".zst"
+	}
+
+	// the upload and checkpoint shouldn't be interrupted half way
+	ctx := context.Background()
+	_, err := s.client.PutObject(ctx, s.bucket, name, &obj.buf, int64(obj.buf.Len()), minio.PutObjectOptions{
+		ContentType: "application/x-ndjson",
+		UserMetadata: map[string]string{
+			"Log-Id":   s.logID.String(),
+			"Encoding": s.coder.String(),
+			"Messages": strconv.FormatInt(obj.messages, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.offsetID != nil {
+		if _, err := klient.Offsets.Set(ctx, *s.offsetID, obj.last+1, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3Object is an object being buffered, before it is uploaded
+type s3Object struct {
+	buf   bytes.Buffer
+	zw    *zstd.Encoder
+	enc   *json.Encoder
+	coder klev.MessageEncoding
+
+	created  time.Time
+	first    int64
+	last     int64
+	messages int64
+	dataSize int64
+}
+
+func (o *s3Object) write(m klev.ConsumeMessage) error {
+	if err := o.enc.Encode(encodeMessage(o.coder, m)); err != nil {
+		return err
+	}
+	o.last = m.Offset
+	o.messages++
+	o.dataSize += int64(len(m.Key) + len(m.Value))
+	return nil
+}
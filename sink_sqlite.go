@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+	_ "modernc.org/sqlite"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func sinkSQLite() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sqlite <log-id>",
+		Short: "write consumed messages to a sqlite database",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	db := cmd.Flags().String("db", "", "sqlite database file, created if missing")
+	table := cmd.Flags().String("table", "messages", "table to write messages to")
+	columns := cmd.Flags().StringArray("column", nil, "extra column from the json value, as name=/json/pointer")
+	offset := cmd.Flags().Int64("offset", klev.OffsetOldest, "the starting offset, when the database has no progress for the log")
+	size := cmd.Flags().Int32("size", 100, "max messages to consume and write at once")
+	follow := cmd.Flags().Bool("follow", false, "keep waiting for new messages, until interrupted")
+	poll := cmd.Flags().Duration("poll", 10*time.Second, "how long to wait for new messages when following")
+
+	cmd.MarkFlagRequired("db")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseLogID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		s := &sqliteSink{logID: id, table: *table}
+		if !sqliteIdent.MatchString(s.table) {
+			return fmt.Errorf("invalid table name '%s'", s.table)
+		}
+		for _, c := range *columns {
+			name, pointer, ok := strings.Cut(c, "=")
+			if !ok || !sqliteIdent.MatchString(name) {
+				return fmt.Errorf("invalid column '%s'. Must be like 'name=/json/pointer'", c)
+			}
+			if sqliteReserved[strings.ToLower(name)] {
+				return fmt.Errorf("column name '%s' is reserved", name)
+			}
+			tokens, err := parseJSONPointer(pointer)
+			if err != nil {
+				return err
+			}
+			s.columns = append(s.columns, sqliteColumn{name, tokens})
+		}
+
+		// the path is escaped, so '?', '#' and '%' in it aren't read as part of the uri
+		dsn := url.URL{Scheme: "file", Opaque: (&url.URL{Path: *db}).EscapedPath(), RawQuery: "_pragma=busy_timeout(5000)"}
+		if s.db, err = sql.Open("sqlite", dsn.String()); err != nil {
+			return err
+		}
+		defer s.db.Close()
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		if err := s.init(ctx); err != nil {
+			return err
+		}
+
+		start, err := s.progress(ctx, *offset)
+		if err != nil {
+			return err
+		}
+
+		out, err := sinkConsume(ctx, id, start, *size, *follow, *poll, func(msgs []klev.ConsumeMessage, next int64) error {
+			if len(msgs) == 0 {
+				return nil
+			}
+			// the write shouldn't be interrupted half way, progress is committed with it
+			if err := s.write(context.Background(), msgs, next); err != nil {
+				return err
+			}
+			if *follow {
+				outputValue(SinkOut{LogID: id, Messages: int64(len(msgs)), NextOffset: next})
+			}
+			return nil
+		})
+		if err != nil {
+			return outputErr(err)
+		}
+		if !*follow {
+			return outputValue(out)
+		}
+		return nil
+	}
+
+	return cmd
+}
+
+var sqliteIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var sqliteReserved = map[string]bool{"offset": true, "time": true, "key": true, "value": true}
+
+type sqliteColumn struct {
+	name    string
+	pointer []string
+}
+
+// sqliteSink writes messages to a table, tracking the next offset to consume
+// in a progress table, updated in the same transaction
+type sqliteSink struct {
+	logID   klev.LogID
+	table   string
+	columns []sqliteColumn
+	db      *sql.DB
+}
+
+func (s *sqliteSink) init(ctx context.Context) error {
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" ("offset" INTEGER PRIMARY KEY, "time" TEXT NOT NULL, "key", "value")`, s.table),
+		`CREATE TABLE IF NOT EXISTS "klev_sink_progress" ("log_id" TEXT NOT NULL, "table" TEXT NOT NULL, "next_offset" INTEGER NOT NULL, PRIMARY KEY ("log_id", "table"))`,
+	}
+	for _, stmt := range stmts {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	existing := map[string]bool{}
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`PRAGMA table_info("%s")`, s.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range s.columns {
+		if existing[strings.ToLower(c.name)] {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN "%s"`, s.table, c.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// progress returns the offset to continue from, or offset without progress
+func (s *sqliteSink) progress(ctx context.Context, offset int64) (int64, error) {
+	var next int64
+	err := s.db.QueryRowContext(ctx, `SELECT "next_offset" FROM "klev_sink_progress" WHERE "log_id" = ? AND "table" = ?`,
+		s.logID.String(), s.table).Scan(&next)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return offset, nil
+	case err != nil:
+		return 0, err
+	}
+	return next, nil
+}
+
+func (s *sqliteSink) write(ctx context.Context, msgs []klev.ConsumeMessage, next int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	names := []string{`"offset"`, `"time"`, `"key"`, `"value"`}
+	for _, c := range s.columns {
+		names = append(names, fmt.Sprintf(`"%s"`, c.name))
+	}
+	insert, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT OR REPLACE INTO "%s" (%s) VALUES (?%s)`,
+		s.table, strings.Join(names, ", "), strings.Repeat(", ?", len(names)-1)))
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, m := range msgs {
+		values := []any{m.Offset, m.Time.UTC().Format(time.RFC3339Nano), sqliteData(m.Key), sqliteData(m.Value)}
+		values = append(values, s.columnValues(m.Value)...)
+		if _, err := insert.ExecContext(ctx, values...); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO "klev_sink_progress" ("log_id", "table", "next_offset") VALUES (?, ?, ?)
+		ON CONFLICT ("log_id", "table") DO UPDATE SET "next_offset" = excluded."next_offset"`, s.logID.String(), s.table, next)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// columnValues extracts the mapped columns from a json value, with NULL for anything missing
+func (s *sqliteSink) columnValues(value []byte) []any {
+	values := make([]any, len(s.columns))
+	if len(s.columns) == 0 {
+		return values
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return values
+	}
+
+	for i, c := range s.columns {
+		v, err := jsonPointerValue(doc, c.pointer)
+		if err != nil {
+			continue
+		}
+		switch v := v.(type) {
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				values[i] = n
+			} else if f, err := v.Float64(); err == nil {
+				values[i] = f
+			} else {
+				values[i] = v.String()
+			}
+		case bool:
+			values[i] = v
+		case string:
+			values[i] = v
+		case nil:
+		default:
+			b, _ := json.Marshal(v)
+			values[i] = string(b)
+		}
+	}
+	return values
+}
+
+// sqliteData stores text as TEXT, so it is easy to query, and anything else as BLOB
+func sqliteData(b []byte) any {
+	switch {
+	case b == nil:
+		return nil
+	case utf8.Valid(b):
+		return string(b)
+	default:
+		return b
+	}
+}
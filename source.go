@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func sourceRoot() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "source",
+		Short: "publish messages from external storage",
+	}
+
+	cmd.AddCommand(sourceS3())
+	cmd.AddCommand(sourcePostgres())
+
+	return cmd
+}
+
+// SourceOut describes messages published by a source
+type SourceOut struct {
+	LogID      klev.LogID `json:"log_id"`
+	Messages   int64      `json:"messages"`
+	NextOffset int64      `json:"next_offset"`
+}
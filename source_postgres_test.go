@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klev-dev/klev-api-go"
+	"github.com/klev-dev/klev-api-go/clients"
+)
+
+func TestOutboxSourcePublish(t *testing.T) {
+	pending := [][]driver.Value{
+		{"(0,1)", `{"id":1}`, "a"},
+		{"(0,2)", `{"id":2}`, nil},
+	}
+
+	tests := []struct {
+		name       string
+		rows       [][]driver.Value
+		publishErr bool
+		commitErr  error
+		err        bool
+		out        SourceOut
+		events     []string
+	}{
+		{
+			name: "published",
+			rows: pending,
+			out:  SourceOut{Messages: 2, NextOffset: 2},
+			// rows are marked before they are published
+			events: []string{"select 2", "mark {\"(0,1)\",\"(0,2)\"}", `publish a={"id":1} {"id":2}`, "commit"},
+		},
+		{
+			name:   "nothing pending",
+			events: []string{"select 2", "rollback"},
+		},
+		{
+			name:       "publish fails",
+			rows:       pending,
+			publishErr: true,
+			err:        true,
+			// the marks are rolled back, so the rows are published again
+			events: []string{"select 2", "mark {\"(0,1)\",\"(0,2)\"}", `publish a={"id":1} {"id":2}`, "rollback"},
+		},
+		{
+			name:      "commit fails",
+			rows:      pending,
+			commitErr: errors.New("connection lost"),
+			err:       true,
+			// already published, the rows are published again too
+			events: []string{"select 2", "mark {\"(0,1)\",\"(0,2)\"}", `publish a={"id":1} {"id":2}`, "commit"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &outboxTestDB{rows: tt.rows, commitErr: tt.commitErr}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var in klev.PublishIn
+				if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+					t.Errorf("invalid publish: %v", err)
+				}
+				var msgs []string
+				for _, m := range in.Messages {
+					key, _ := in.Encoding.DecodeData(m.Key)
+					value, _ := in.Encoding.DecodeData(m.Value)
+					if key != nil {
+						msgs = append(msgs, fmt.Sprintf("%s=%s", key, value))
+					} else {
+						msgs = append(msgs, string(value))
+					}
+				}
+				d.event("publish " + strings.Join(msgs, " "))
+
+				w.Header().Set("Content-Type", "application/json")
+				if tt.publishErr {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(klev.APIError{Code: "invalid", Message: "rejected"})
+					return
+				}
+				json.NewEncoder(w).Encode(klev.PublishOut{NextOffset: int64(len(in.Messages))})
+			}))
+			defer srv.Close()
+
+			prev := klient
+			klient = clients.New(klev.Config{BaseURL: srv.URL, Token: "test", Client: srv.Client()})
+			defer func() { klient = prev }()
+
+			db := sql.OpenDB(d)
+			defer db.Close()
+			s := &outboxSource{
+				db:              db,
+				table:           `"outbox"`,
+				idColumn:        `"id"`,
+				keyColumn:       `"key"`,
+				publishedColumn: `"published_at"`,
+				batchSize:       2,
+			}
+
+			out, err := s.publish()
+			switch {
+			case tt.err && err == nil:
+				t.Fatalf("expected an error")
+			case !tt.err && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case !tt.err && (out.Messages != tt.out.Messages || out.NextOffset != tt.out.NextOffset):
+				t.Fatalf("expected %+v, got %+v", tt.out, out)
+			}
+			if !reflect.DeepEqual(d.events, tt.events) {
+				t.Fatalf("expected %q, got %q", tt.events, d.events)
+			}
+		})
+	}
+}
+
+// outboxTestDB is a database/sql driver, returning rows for the select of
+// outboxSource and recording what it does with them
+type outboxTestDB struct {
+	rows      [][]driver.Value
+	commitErr error
+
+	mu     sync.Mutex
+	events []string
+}
+
+func (d *outboxTestDB) event(e string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, e)
+}
+
+func (d *outboxTestDB) Connect(ctx context.Context) (driver.Conn, error) { return d, nil }
+func (d *outboxTestDB) Driver() driver.Driver                            { return nil }
+
+func (d *outboxTestDB) Prepare(query string) (driver.Stmt, error) {
+	return outboxTestStmt{d, strings.Fields(query)[0]}, nil
+}
+func (d *outboxTestDB) Close() error              { return nil }
+func (d *outboxTestDB) Begin() (driver.Tx, error) { return d, nil }
+
+func (d *outboxTestDB) Commit() error {
+	d.event("commit")
+	return d.commitErr
+}
+
+func (d *outboxTestDB) Rollback() error {
+	d.event("rollback")
+	return nil
+}
+
+type outboxTestStmt struct {
+	d    *outboxTestDB
+	verb string
+}
+
+func (s outboxTestStmt) Close() error  { return nil }
+func (s outboxTestStmt) NumInput() int { return -1 }
+
+func (s outboxTestStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.verb != "UPDATE" {
+		return nil, fmt.Errorf("unexpected exec %s", s.verb)
+	}
+	s.d.event(fmt.Sprintf("mark %s", args[0]))
+	return driver.RowsAffected(len(s.d.rows)), nil
+}
+
+func (s outboxTestStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.verb != "SELECT" {
+		return nil, fmt.Errorf("unexpected query %s", s.verb)
+	}
+	s.d.event(fmt.Sprintf("select %d", args[0]))
+	return &outboxTestRows{rows: s.d.rows}, nil
+}
+
+type outboxTestRows struct {
+	rows [][]driver.Value
+}
+
+func (r *outboxTestRows) Columns() []string { return []string{"ctid", "row_to_json", "key"} }
+func (r *outboxTestRows) Close() error      { return nil }
+
+func (r *outboxTestRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
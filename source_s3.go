@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+func sourceS3() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "s3 <log-id>",
+		Short: "publish messages archived in s3 compatible storage by 'sink s3'",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	store := addS3Flags(cmd)
+	fromLog := cmd.Flags().String("from-log", "", "log id the objects were archived from, defaults to the log to publish to")
+	fromOffset := cmd.Flags().Int64("from-offset", 0, "first archived offset to publish")
+	toOffset := cmd.Flags().Int64("to-offset", -1, "last archived offset to publish, or all when negative")
+	batchSize := cmd.Flags().Int("batch-size", 100, "max messages to publish at once")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseLogID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+		archived := id
+		if *fromLog != "" {
+			if archived, err = klev.ParseLogID(*fromLog); err != nil {
+				return outputErr(err)
+			}
+		}
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		client, err := store.open(ctx)
+		if err != nil {
+			return err
+		}
+
+		src := &s3Source{
+			client:     client,
+			bucket:     *store.bucket,
+			logID:      id,
+			fromOffset: *fromOffset,
+			toOffset:   *toOffset,
+			batchSize:  *batchSize,
+			out:        SourceOut{LogID: id},
+		}
+
+		prefix := s3LogPrefix(*store.prefix, archived)
+		for obj := range client.ListObjects(ctx, src.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if obj.Err != nil {
+				return outputErr(obj.Err)
+			}
+			first, last, zst, ok := parseS3ObjectName(obj.Key)
+			if !ok || last < src.fromOffset || (src.toOffset >= 0 && first > src.toOffset) {
+				continue
+			}
+			if err := src.publishObject(ctx, obj.Key, zst); err != nil {
+				return outputErr(fmt.Errorf("%s: %w", obj.Key, err))
+			}
+		}
+		if err := src.publish(ctx); err != nil {
+			return outputErr(err)
+		}
+		return outputValue(src.out)
+	}
+
+	return cmd
+}
+
+// s3Source publishes messages of archived objects in batches, keeping their time
+type s3Source struct {
+	client     *minio.Client
+	bucket     string
+	logID      klev.LogID
+	fromOffset int64
+	toOffset   int64
+	batchSize  int
+
+	batch []klev.PublishMessage
+	out   SourceOut
+}
+
+func (s *s3Source) publishObject(ctx context.Context, name string, zst bool) error {
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if err != nil {
+		return err
+	}
+	coder := klev.MessageEncodingBase64
+	if enc, ok := info.UserMetadata["Encoding"]; ok {
+		if coder, err = klev.ParseMessageEncoding(enc); err != nil {
+			return err
+		}
+	}
+
+	var r io.Reader = obj
+	if zst {
+		zr, err := zstd.NewReader(obj)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var out klev.ConsumeMessageOut
+		switch err := dec.Decode(&out); {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return err
+		}
+		if out.Offset < s.fromOffset || (s.toOffset >= 0 && out.Offset > s.toOffset) {
+			continue
+		}
+
+		m, err := out.Decode(coder)
+		if err != nil {
+			return err
+		}
+		s.batch = append(s.batch, klev.PublishMessage{Time: m.Time, Key: m.Key, Value: m.Value})
+		if len(s.batch) >= s.batchSize {
+			if err := s.publish(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *s3Source) publish(ctx context.Context) error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	next, err := klient.Messages.Publish(ctx, s.logID, s.batch)
+	if err != nil {
+		return err
+	}
+	s.out.Messages += int64(len(s.batch))
+	s.out.NextOffset = next
+	s.batch = s.batch[:0]
+	return nil
+}
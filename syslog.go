@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+// SyslogMessage is the value published for each syslog message
+type SyslogMessage struct {
+	Facility       string                       `json:"facility"`
+	Severity       string                       `json:"severity"`
+	Host           string                       `json:"host,omitempty"`
+	App            string                       `json:"app,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"message"`
+
+	time time.Time
+}
+
+// SyslogBatchOut describes a batch of messages published by syslog-server
+type SyslogBatchOut struct {
+	Messages   int   `json:"messages"`
+	NextOffset int64 `json:"next_offset"`
+}
+
+func syslogServer() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "syslog-server",
+		Short: "receive syslog messages and publish them to a log",
+		Args:  cobra.NoArgs,
+	}
+
+	listen := cmd.Flags().StringSlice("listen", []string{"udp://:5514"}, "addresses to listen on, as udp://host:port or tcp://host:port")
+	logID := cmd.Flags().String("log-id", "", "log to publish messages to")
+	keyField := cmd.Flags().String("key", "host", "message field to use as key: host or app")
+	batchSize := cmd.Flags().Int("batch-size", 100, "max messages to publish at once")
+	batchInterval := cmd.Flags().Duration("batch-interval", time.Second, "max time to wait for a batch to fill")
+
+	cmd.MarkFlagRequired("log-id")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseLogID(*logID)
+		if err != nil {
+			return outputErr(err)
+		}
+		if *keyField != "host" && *keyField != "app" {
+			return fmt.Errorf("unknown key '%s'. Must be one of 'host, app'", *keyField)
+		}
+		if *batchSize <= 0 {
+			return fmt.Errorf("batch-size must be positive")
+		}
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		go func() {
+			// restore the default handling, so a second signal stops waiting for klev
+			<-ctx.Done()
+			cancel()
+		}()
+
+		msgs := make(chan SyslogMessage, *batchSize)
+		var wg sync.WaitGroup
+		for _, addr := range *listen {
+			u, err := url.Parse(addr)
+			if err != nil {
+				return fmt.Errorf("invalid listen address %s: %w", addr, err)
+			}
+
+			switch u.Scheme {
+			case "udp":
+				conn, err := net.ListenPacket("udp", u.Host)
+				if err != nil {
+					return err
+				}
+				go func() {
+					<-ctx.Done()
+					conn.Close()
+				}()
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					serveSyslogUDP(conn, msgs)
+				}()
+			case "tcp":
+				l, err := net.Listen("tcp", u.Host)
+				if err != nil {
+					return err
+				}
+				go func() {
+					<-ctx.Done()
+					l.Close()
+				}()
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					serveSyslogTCP(ctx, l, msgs)
+				}()
+			default:
+				return fmt.Errorf("unknown listen scheme '%s'. Must be one of 'udp, tcp'", u.Scheme)
+			}
+			fmt.Fprintf(os.Stderr, "listening for syslog at %s\n", addr)
+		}
+
+		go func() {
+			wg.Wait()
+			close(msgs)
+		}()
+
+		return outputErr(publishSyslog(ctx, id, *keyField, *batchSize, *batchInterval, msgs))
+	}
+
+	return cmd
+}
+
+func serveSyslogUDP(conn net.PacketConn, msgs chan<- SyslogMessage) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			return
+		}
+		msgs <- parseSyslog(bytes.TrimRight(buf[:n], "\r\n\x00"), hostOf(addr), time.Now())
+	}
+}
+
+func serveSyslogTCP(ctx context.Context, l net.Listener, msgs chan<- SyslogMessage) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+
+			host := hostOf(conn.RemoteAddr())
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			scanner.Split(splitSyslogFrames)
+			for scanner.Scan() {
+				if frame := bytes.TrimRight(scanner.Bytes(), "\r\n\x00"); len(frame) > 0 {
+					msgs <- parseSyslog(frame, host, time.Now())
+				}
+			}
+			if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}()
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// splitSyslogFrames splits a tcp stream using octet counting ("<len> <msg>")
+// when a frame starts with a digit, and by newlines otherwise (RFC 6587)
+func splitSyslogFrames(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if data[0] >= '0' && data[0] <= '9' {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			if atEOF {
+				return len(data), data, nil
+			}
+			return 0, nil, nil
+		}
+		n, err := strconv.Atoi(string(data[:sp]))
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid syslog frame length: %w", err)
+		}
+		if len(data) < sp+1+n {
+			if atEOF {
+				return len(data), data[sp+1:], nil
+			}
+			return 0, nil, nil
+		}
+		return sp + 1 + n, data[sp+1 : sp+1+n], nil
+	}
+
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// syslogShutdownTimeout bounds publishing the last messages when stopping
+const syslogShutdownTimeout = 10 * time.Second
+
+// publishSyslog publishes batches of messages until msgs is closed. once ctx is done,
+// the messages still received are published within syslogShutdownTimeout
+func publishSyslog(ctx context.Context, id klev.LogID, keyField string, batchSize int, batchInterval time.Duration, msgs <-chan SyslogMessage) error {
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	var batch []klev.PublishMessage
+	flush := func(ctx context.Context) error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		var next int64
+		err := retryIf(ctx, klevRetriable, func() error {
+			var err error
+			next, err = klient.Messages.Publish(ctx, id, batch)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		outputValue(SyslogBatchOut{Messages: len(batch), NextOffset: next})
+		batch = nil
+		return nil
+	}
+
+	for {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				ctx, cancel := context.WithTimeout(context.Background(), syslogShutdownTimeout)
+				defer cancel()
+				err := flush(ctx)
+				if errors.Is(err, context.DeadlineExceeded) {
+					return fmt.Errorf("%d messages not published before stopping: %w", len(batch), err)
+				}
+				return err
+			}
+
+			value, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			key := m.Host
+			if keyField == "app" {
+				key = m.App
+			}
+			batch = append(batch, klev.PublishMessage{Time: m.time, Key: []byte(key), Value: value})
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		if err := flush(ctx); err != nil && ctx.Err() == nil {
+			// when interrupted, the batch is published once the listeners are closed
+			return err
+		}
+	}
+}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// parseSyslog parses RFC 5424 and RFC 3164 messages. it is lenient, anything
+// it can't make sense of ends up in the message, with the sender as the host
+func parseSyslog(b []byte, sender string, now time.Time) SyslogMessage {
+	// messages without priority are user.notice
+	m := SyslogMessage{Facility: "user", Severity: "notice", time: now}
+
+	s := string(b)
+	if strings.HasPrefix(s, "<") {
+		if end := strings.IndexByte(s, '>'); end > 1 && end <= 4 {
+			if pri, err := strconv.Atoi(s[1:end]); err == nil && pri >= 0 && pri < len(syslogFacilities)*8 {
+				m.Facility, m.Severity = syslogFacilities[pri/8], syslogSeverities[pri%8]
+				s = s[end+1:]
+			}
+		}
+	}
+
+	if strings.HasPrefix(s, "1 ") {
+		parseSyslog5424(&m, s[2:])
+	} else {
+		parseSyslog3164(&m, s, now)
+	}
+
+	if m.Host == "" {
+		m.Host = sender
+	}
+	return m
+}
+
+func parseSyslog5424(m *SyslogMessage, s string) {
+	next := func() string {
+		var field string
+		if i := strings.IndexByte(s, ' '); i >= 0 {
+			field, s = s[:i], s[i+1:]
+		} else {
+			field, s = s, ""
+		}
+		if field == "-" {
+			return ""
+		}
+		return field
+	}
+
+	if ts := next(); ts != "" {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			m.time = t
+		}
+	}
+	m.Host = next()
+	m.App = next()
+	m.ProcID = next()
+	m.MsgID = next()
+
+	if strings.HasPrefix(s, "-") {
+		s = strings.TrimPrefix(s[1:], " ")
+	} else {
+		m.StructuredData, s = parseSyslogSD(s)
+	}
+	m.Message = strings.TrimPrefix(s, "\ufeff")
+}
+
+// parseSyslogSD parses structured data elements, like [id key="value"],
+// returning them with the rest of the message
+func parseSyslogSD(s string) (map[string]map[string]string, string) {
+	sd := map[string]map[string]string{}
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		end := strings.IndexAny(s, " ]")
+		if end < 0 {
+			break
+		}
+		params := map[string]string{}
+		sd[s[:end]] = params
+		s = s[end:]
+
+		for strings.HasPrefix(s, " ") {
+			s = strings.TrimLeft(s, " ")
+			eq := strings.Index(s, `="`)
+			if eq < 0 {
+				break
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+
+			var value strings.Builder
+			for len(s) > 0 && s[0] != '"' {
+				if s[0] == '\\' && len(s) > 1 && (s[1] == '"' || s[1] == '\\' || s[1] == ']') {
+					s = s[1:]
+				}
+				value.WriteByte(s[0])
+				s = s[1:]
+			}
+			params[name] = value.String()
+			s = strings.TrimPrefix(s, `"`)
+		}
+		s = strings.TrimPrefix(s, "]")
+	}
+
+	if len(sd) == 0 {
+		sd = nil
+	}
+	return sd, strings.TrimPrefix(s, " ")
+}
+
+func parseSyslog3164(m *SyslogMessage, s string, now time.Time) {
+	// the timestamp, like "Jan  2 15:04:05", has no year
+	if len(s) > len(time.Stamp) && s[len(time.Stamp)] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], time.Local); err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.AddDate(0, 0, 1)) {
+				// sent at the end of last year
+				t = t.AddDate(-1, 0, 0)
+			}
+			m.time = t
+			s = s[len(time.Stamp)+1:]
+
+			if i := strings.IndexByte(s, ' '); i > 0 {
+				m.Host, s = s[:i], s[i+1:]
+			}
+		}
+	}
+
+	// the tag, like "app[123]: ", ends at the first non-alphanumeric character
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' || r == '/')
+	})
+	if end > 0 && end <= 48 {
+		rest := s[end:]
+		if strings.HasPrefix(rest, "[") {
+			if end := strings.IndexByte(rest, ']'); end > 0 {
+				m.ProcID = rest[1:end]
+				rest = rest[end+1:]
+			}
+		}
+		if strings.HasPrefix(rest, ":") {
+			m.App = s[:end]
+			s = strings.TrimPrefix(rest[1:], " ")
+		} else {
+			m.ProcID = ""
+		}
+	}
+	m.Message = s
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2024, time.June, 15, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name string
+		in   string
+		now  time.Time
+		out  SyslogMessage
+		time time.Time
+	}{
+		{
+			name: "rfc5424",
+			in:   `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"] An application event`,
+			out: SyslogMessage{
+				Facility: "local4", Severity: "notice", Host: "mymachine.example.com", App: "evntslog", MsgID: "ID47",
+				StructuredData: map[string]map[string]string{"exampleSDID@32473": {"iut": "3", "eventSource": "Application"}},
+				Message:        "An application event",
+			},
+			time: time.Date(2003, time.October, 11, 22, 14, 15, 3000000, time.UTC),
+		},
+		{
+			name: "rfc5424 without structured data",
+			in:   "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su 42 - - \ufeff'su root' failed",
+			out:  SyslogMessage{Facility: "auth", Severity: "crit", Host: "mymachine.example.com", App: "su", ProcID: "42", Message: "'su root' failed"},
+			time: time.Date(2003, time.October, 11, 22, 14, 15, 3000000, time.UTC),
+		},
+		{
+			name: "rfc5424 nil fields",
+			in:   `<14>1 - - - - - - hello`,
+			out:  SyslogMessage{Facility: "user", Severity: "info", Host: "10.0.0.1", Message: "hello"},
+			time: now,
+		},
+		{
+			name: "rfc5424 escaped structured data",
+			in:   `<14>1 - host app - - [a b="x\"y\]z" c="\\"][d] text`,
+			out: SyslogMessage{
+				Facility: "user", Severity: "info", Host: "host", App: "app",
+				StructuredData: map[string]map[string]string{"a": {"b": `x"y]z`, "c": `\`}, "d": {}},
+				Message:        "text",
+			},
+			time: now,
+		},
+		{
+			name: "rfc3164",
+			in:   `<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8`,
+			out:  SyslogMessage{Facility: "auth", Severity: "crit", Host: "mymachine", App: "su", ProcID: "123", Message: "'su root' failed for lonvick on /dev/pts/8"},
+			// after now, so it was sent last year
+			time: time.Date(2023, time.October, 11, 22, 14, 15, 0, time.Local),
+		},
+		{
+			name: "rfc3164 without pid",
+			in:   `<13>Jun 15 11:59:00 web-1 nginx: GET /`,
+			out:  SyslogMessage{Facility: "user", Severity: "notice", Host: "web-1", App: "nginx", Message: "GET /"},
+			time: time.Date(2024, time.June, 15, 11, 59, 0, 0, time.Local),
+		},
+		{
+			name: "rfc3164 from last year",
+			in:   `<13>Dec 31 23:59:59 web-1 cron: done`,
+			now:  time.Date(2024, time.January, 1, 0, 0, 5, 0, time.Local),
+			out:  SyslogMessage{Facility: "user", Severity: "notice", Host: "web-1", App: "cron", Message: "done"},
+			time: time.Date(2023, time.December, 31, 23, 59, 59, 0, time.Local),
+		},
+		{
+			name: "rfc3164 without tag",
+			in:   `<13>Jun 15 11:59:00 web-1 just a message`,
+			out:  SyslogMessage{Facility: "user", Severity: "notice", Host: "web-1", Message: "just a message"},
+			time: time.Date(2024, time.June, 15, 11, 59, 0, 0, time.Local),
+		},
+		{
+			name: "without priority",
+			in:   `plain message`,
+			out:  SyslogMessage{Facility: "user", Severity: "notice", Host: "10.0.0.1", Message: "plain message"},
+			time: now,
+		},
+		{
+			name: "invalid priority",
+			in:   `<999>hello`,
+			out:  SyslogMessage{Facility: "user", Severity: "notice", Host: "10.0.0.1", Message: "<999>hello"},
+			time: now,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := now
+			if !tt.now.IsZero() {
+				n = tt.now
+			}
+			m := parseSyslog([]byte(tt.in), "10.0.0.1", n)
+			if !m.time.Equal(tt.time) {
+				t.Errorf("expected time %v, got %v", tt.time, m.time)
+			}
+			m.time = time.Time{}
+			if !reflect.DeepEqual(m, tt.out) {
+				t.Errorf("expected %+v, got %+v", tt.out, m)
+			}
+		})
+	}
+}
+
+func TestSplitSyslogFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		frames []string
+	}{
+		{"non-transparent", "<13>one\n<13>two\n", []string{"<13>one", "<13>two"}},
+		{"non-transparent without final newline", "<13>one\n<13>two", []string{"<13>one", "<13>two"}},
+		{"octet-counted", "7 <13>one9 <13>two\nx", []string{"<13>one", "<13>two\nx"}},
+		{"mixed", "7 <13>one<13>two\n", []string{"<13>one", "<13>two"}},
+		{"octet-counted truncated", "12 <13>one", []string{"<13>one"}},
+		{"empty frames", "\n\n<13>one\n", []string{"", "", "<13>one"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// read a byte at a time, so frames are split across reads
+			s := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(tt.in)))
+			s.Split(splitSyslogFrames)
+
+			var frames []string
+			for s.Scan() {
+				frames = append(frames, s.Text())
+			}
+			if err := s.Err(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(frames, tt.frames) {
+				t.Fatalf("expected %q, got %q", tt.frames, frames)
+			}
+		})
+	}
+
+	t.Run("invalid length", func(t *testing.T) {
+		s := bufio.NewScanner(strings.NewReader("99999999999999999999 x"))
+		s.Split(splitSyslogFrames)
+		if s.Scan() {
+			t.Fatalf("unexpected frame %q", s.Text())
+		}
+		if s.Err() == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+// TailOut describes a batch of records published by publish-tail
+type TailOut struct {
+	File       string `json:"file"`
+	FileOffset int64  `json:"file_offset"`
+	Messages   int    `json:"messages"`
+	NextOffset int64  `json:"next_offset"`
+}
+
+func publishTail() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "publish-tail <log-id>",
+		Short: "follow a file and publish each new line (or multiline record)",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	file := cmd.Flags().String("file", "", "file to follow")
+	key := cmd.Flags().String("key", "", "key to publish the records with")
+	stateFile := cmd.Flags().String("state-file", "", "file to persist the read position to, so restarts continue where they stopped")
+	fromBeginning := cmd.Flags().Bool("from-beginning", false, "without a saved position, start at the beginning of the file instead of its end")
+	multilineStart := cmd.Flags().String("multiline-start", "", "regexp matching the first line of a record, other lines are appended to the previous record")
+	multilineTimeout := cmd.Flags().Duration("multiline-timeout", time.Second, "how long to wait for more lines before publishing a multiline record")
+	timeRegexp := cmd.Flags().String("time-regexp", "", "regexp to find the record timestamp, using the first group if any. records without one use the arrival time")
+	timeLayout := cmd.Flags().String("time-layout", time.RFC3339, "go time layout of the timestamp found by time-regexp")
+	pollInterval := cmd.Flags().Duration("poll-interval", 250*time.Millisecond, "how often to check the file for new lines")
+	batchSize := cmd.Flags().Int("batch-size", 100, "max records to publish at once")
+
+	cmd.MarkFlagRequired("file")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseLogID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+		if *batchSize <= 0 {
+			return fmt.Errorf("batch-size must be positive")
+		}
+
+		asm := &tailAssembler{}
+		if *multilineStart != "" {
+			if asm.start, err = regexp.Compile(*multilineStart); err != nil {
+				return fmt.Errorf("invalid multiline-start: %w", err)
+			}
+		}
+		if *timeRegexp != "" {
+			if asm.timeRegexp, err = regexp.Compile(*timeRegexp); err != nil {
+				return fmt.Errorf("invalid time-regexp: %w", err)
+			}
+			asm.timeLayout = *timeLayout
+		}
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		t := &tailer{
+			id:        id,
+			key:       []byte(*key),
+			path:      *file,
+			stateFile: *stateFile,
+			batchSize: *batchSize,
+			asm:       asm,
+		}
+		if err := t.start(ctx, *fromBeginning); err != nil {
+			return outputErr(err)
+		}
+		defer t.file.close()
+
+		ticker := time.NewTicker(*pollInterval)
+		defer ticker.Stop()
+		for {
+			if err := t.poll(ctx, *multilineTimeout); err != nil {
+				if errors.Is(err, context.Canceled) {
+					return nil
+				}
+				return outputErr(err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+
+	return cmd
+}
+
+// tailState is the persisted read position. the file is recognized by
+// the checksum of its first bytes, which survives renames during rotation
+type tailState struct {
+	Path            string `json:"path"`
+	Offset          int64  `json:"offset"`
+	Fingerprint     string `json:"fingerprint"`
+	FingerprintSize int64  `json:"fingerprint_size"`
+}
+
+const tailFingerprintSize = 1024
+
+func readTailState(path string) (*tailState, error) {
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	var st tailState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return &st, nil
+}
+
+func writeTailState(path string, st tailState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// tailFile is an open file being followed
+type tailFile struct {
+	path    string
+	f       *os.File
+	info    os.FileInfo
+	read    int64  // position of the next read
+	partial []byte // read bytes not yet terminated by a newline
+}
+
+func openTailFile(path string) (*tailFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &tailFile{path: path, f: f, info: info}, nil
+}
+
+func (t *tailFile) close() error {
+	return t.f.Close()
+}
+
+func (t *tailFile) seek(offset int64) error {
+	if _, err := t.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	t.read = offset
+	t.partial = nil
+	return nil
+}
+
+func (t *tailFile) fingerprint(size int64) (string, error) {
+	b := make([]byte, size)
+	if _, err := t.f.ReadAt(b, 0); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// matches checks if this is the file the state was saved for
+func (t *tailFile) matches(st *tailState) bool {
+	if t.info.Size() < st.FingerprintSize || t.info.Size() < st.Offset {
+		return false
+	}
+	fp, err := t.fingerprint(st.FingerprintSize)
+	return err == nil && fp == st.Fingerprint
+}
+
+func (t *tailFile) state(offset int64) (tailState, error) {
+	info, err := t.f.Stat()
+	if err != nil {
+		return tailState{}, err
+	}
+
+	size := info.Size()
+	if size > tailFingerprintSize {
+		size = tailFingerprintSize
+	}
+	fp, err := t.fingerprint(size)
+	if err != nil {
+		return tailState{}, err
+	}
+	return tailState{Path: t.path, Offset: offset, Fingerprint: fp, FingerprintSize: size}, nil
+}
+
+// readLines reads until the end of the file, calling fn for each complete line,
+// with the file offset right after it
+func (t *tailFile) readLines(fn func(line []byte, end int64)) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := t.f.Read(buf)
+		if n > 0 {
+			t.read += int64(n)
+			t.partial = append(t.partial, buf[:n]...)
+
+			start := t.read - int64(len(t.partial))
+			for {
+				i := bytes.IndexByte(t.partial, '\n')
+				if i < 0 {
+					break
+				}
+				line := bytes.TrimSuffix(t.partial[:i], []byte("\r"))
+				fn(append([]byte(nil), line...), start+int64(i)+1)
+
+				start += int64(i) + 1
+				t.partial = t.partial[i+1:]
+			}
+			t.partial = append([]byte(nil), t.partial...)
+		}
+
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// drain reads the rest of a file that won't be written to anymore,
+// including a last line without a newline
+func (t *tailFile) drain(fn func(line []byte, end int64)) error {
+	if err := t.readLines(fn); err != nil {
+		return err
+	}
+	if len(t.partial) > 0 {
+		fn(t.partial, t.read)
+		t.partial = nil
+	}
+	return nil
+}
+
+// tailRecord is a line, or lines of a multiline record, ready to publish
+type tailRecord struct {
+	value []byte
+	time  time.Time
+	end   int64
+}
+
+// tailAssembler groups lines into records and finds their time
+type tailAssembler struct {
+	start      *regexp.Regexp
+	timeRegexp *regexp.Regexp
+	timeLayout string
+
+	pending *tailRecord
+	last    time.Time
+}
+
+// add returns a record when one is complete
+func (a *tailAssembler) add(line []byte, end int64, now time.Time) *tailRecord {
+	if a.start == nil {
+		return a.record(line, end, now)
+	}
+
+	if a.pending != nil && !a.start.Match(line) {
+		a.pending.value = append(append(a.pending.value, '\n'), line...)
+		a.pending.end = end
+		a.last = now
+		return nil
+	}
+
+	complete := a.pending
+	a.pending = a.record(line, end, now)
+	a.last = now
+	return complete
+}
+
+// flush returns the pending multiline record, if it waited long enough
+func (a *tailAssembler) flush(now time.Time, timeout time.Duration) *tailRecord {
+	if a.pending == nil || now.Sub(a.last) < timeout {
+		return nil
+	}
+	complete := a.pending
+	a.pending = nil
+	return complete
+}
+
+func (a *tailAssembler) record(line []byte, end int64, now time.Time) *tailRecord {
+	r := &tailRecord{value: line, time: now, end: end}
+	if a.timeRegexp == nil {
+		return r
+	}
+
+	m := a.timeRegexp.FindSubmatch(line)
+	switch {
+	case m == nil:
+		return r
+	case len(m) > 1:
+		m[0] = m[1]
+	}
+	if t, err := time.ParseInLocation(a.timeLayout, string(m[0]), time.Local); err == nil {
+		r.time = t
+	}
+	return r
+}
+
+// tailer follows a file through rotation and truncation, publishing its records
+type tailer struct {
+	id        klev.LogID
+	key       []byte
+	path      string
+	stateFile string
+	batchSize int
+	asm       *tailAssembler
+
+	file *tailFile
+}
+
+// start opens the file, continuing from the saved position. when the file was
+// rotated since, the rest of the rotated file is published first
+func (t *tailer) start(ctx context.Context, fromBeginning bool) error {
+	var st *tailState
+	if t.stateFile != "" {
+		var err error
+		if st, err = readTailState(t.stateFile); err != nil {
+			return err
+		}
+	}
+
+	f, err := openTailFile(t.path)
+	if err != nil {
+		return err
+	}
+	t.file = f
+
+	switch {
+	case st != nil && f.matches(st):
+		return f.seek(st.Offset)
+	case st != nil:
+		if err := t.drainRotated(ctx, st); err != nil {
+			return err
+		}
+		return t.save(f, 0)
+	case fromBeginning:
+		return nil
+	default:
+		return f.seek(f.info.Size())
+	}
+}
+
+// drainRotated looks for the file the state was saved for next to the followed file
+func (t *tailer) drainRotated(ctx context.Context, st *tailState) error {
+	var candidates []string
+	for _, pattern := range []string{t.path + ".*", t.path + "-*"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		candidates = append(candidates, matches...)
+	}
+
+	for _, c := range candidates {
+		f, err := openTailFile(c)
+		if err != nil {
+			continue
+		}
+		if !f.matches(st) {
+			f.close()
+			continue
+		}
+		defer f.close()
+
+		fmt.Fprintf(os.Stderr, "%s was rotated to %s, publishing its remaining lines\n", t.path, c)
+		if err := f.seek(st.Offset); err != nil {
+			return err
+		}
+		return t.drain(ctx, f)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s changed and the previous file was not found, starting at its beginning\n", t.path)
+	return nil
+}
+
+// drain publishes everything left in a file
+func (t *tailer) drain(ctx context.Context, f *tailFile) error {
+	var records []tailRecord
+	err := f.drain(func(line []byte, end int64) {
+		if r := t.asm.add(line, end, time.Now()); r != nil {
+			records = append(records, *r)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if r := t.asm.flush(time.Now(), 0); r != nil {
+		records = append(records, *r)
+	}
+	return t.publish(ctx, f, records)
+}
+
+// poll publishes new records, then handles truncation and rotation of the file
+func (t *tailer) poll(ctx context.Context, multilineTimeout time.Duration) error {
+	var records []tailRecord
+	err := t.file.readLines(func(line []byte, end int64) {
+		if r := t.asm.add(line, end, time.Now()); r != nil {
+			records = append(records, *r)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if r := t.asm.flush(time.Now(), multilineTimeout); r != nil {
+		records = append(records, *r)
+	}
+	if err := t.publish(ctx, t.file, records); err != nil {
+		return err
+	}
+
+	info, err := t.file.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < t.file.read {
+		fmt.Fprintf(os.Stderr, "%s was truncated, starting at its beginning\n", t.path)
+		t.asm.pending = nil
+		if err := t.file.seek(0); err != nil {
+			return err
+		}
+		return t.save(t.file, 0)
+	}
+
+	pathInfo, err := os.Stat(t.path)
+	if err != nil || os.SameFile(t.file.info, pathInfo) {
+		// not rotated, or the new file is not created yet
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "%s was rotated, switching to the new file\n", t.path)
+	if err := t.drain(ctx, t.file); err != nil {
+		return err
+	}
+	f, err := openTailFile(t.path)
+	if err != nil {
+		return err
+	}
+	t.file.close()
+	t.file = f
+	return t.save(f, 0)
+}
+
+// publish sends the records in batches, retrying until they are published,
+// or klev rejects them. after each batch, the position in the file is saved
+func (t *tailer) publish(ctx context.Context, f *tailFile, records []tailRecord) error {
+	for len(records) > 0 {
+		batch := records
+		if len(batch) > t.batchSize {
+			batch = batch[:t.batchSize]
+		}
+		records = records[len(batch):]
+
+		msgs := make([]klev.PublishMessage, len(batch))
+		for i, r := range batch {
+			msgs[i] = klev.PublishMessage{Time: r.time, Key: t.key, Value: r.value}
+		}
+
+		var next int64
+		err := retryIf(ctx, klevRetriable, func() error {
+			var err error
+			next, err = klient.Messages.Publish(ctx, t.id, msgs)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		end := batch[len(batch)-1].end
+		if err := t.save(f, end); err != nil {
+			return err
+		}
+		outputValue(TailOut{File: f.path, FileOffset: end, Messages: len(batch), NextOffset: next})
+	}
+	return nil
+}
+
+func (t *tailer) save(f *tailFile, offset int64) error {
+	if t.stateFile == "" {
+		return nil
+	}
+	st, err := f.state(offset)
+	if err != nil {
+		return err
+	}
+	return writeTailState(t.stateFile, st)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// tailTestRecord is a tailRecord that is easy to compare
+type tailTestRecord struct {
+	value string
+	end   int64
+	time  time.Time
+}
+
+func (r tailTestRecord) equal(o tailTestRecord) bool {
+	return r.value == o.value && r.end == o.end && r.time.Equal(o.time)
+}
+
+func TestTailAssembler(t *testing.T) {
+	now := time.Date(2024, time.June, 15, 12, 0, 0, 0, time.Local)
+
+	type record = tailTestRecord
+	tests := []struct {
+		name      string
+		start     string
+		timeRe    string
+		layout    string
+		lines     []string
+		records   []record
+		flushed   *record
+		pending   bool
+		flushWait time.Duration
+	}{
+		{
+			name:    "single lines",
+			lines:   []string{"one", "two"},
+			records: []record{{"one", 4, now}, {"two", 8, now}},
+		},
+		{
+			name:    "multiline",
+			start:   `^\d`,
+			lines:   []string{"1 panic", "  at a", "  at b", "2 next"},
+			records: []record{{"1 panic\n  at a\n  at b", 22, now}},
+			flushed: &record{"2 next", 29, now},
+		},
+		{
+			name:    "multiline starting with a continuation",
+			start:   `^\d`,
+			lines:   []string{"  at a", "1 first"},
+			records: []record{{"  at a", 7, now}},
+			flushed: &record{"1 first", 15, now},
+		},
+		{
+			name:      "multiline waiting for more lines",
+			start:     `^\d`,
+			lines:     []string{"1 panic", "  at a"},
+			pending:   true,
+			flushWait: time.Minute,
+		},
+		{
+			name:    "time",
+			timeRe:  `^\S+`,
+			layout:  time.RFC3339,
+			lines:   []string{"2024-01-02T03:04:05Z started", "no time"},
+			records: []record{{"2024-01-02T03:04:05Z started", 29, time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)}, {"no time", 37, now}},
+		},
+		{
+			name:    "time group",
+			timeRe:  `\[(.+?)\]`,
+			layout:  "02/Jan/2006:15:04:05 -0700",
+			lines:   []string{`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /"`, "[not a time]"},
+			records: []record{{`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /"`, 51, time.Date(2000, time.October, 10, 20, 55, 36, 0, time.UTC)}, {"[not a time]", 64, now}},
+		},
+		{
+			name:    "time of the first multiline line",
+			start:   `^\S`,
+			timeRe:  `^\S+`,
+			layout:  time.RFC3339,
+			lines:   []string{"2024-01-02T03:04:05Z failed", "2024-01-02T09:09:09Z", "x"},
+			records: []record{{"2024-01-02T03:04:05Z failed", 28, time.Date(2024, time.January, 2, 3, 4, 5, 0, time.UTC)}, {"2024-01-02T09:09:09Z", 49, time.Date(2024, time.January, 2, 9, 9, 9, 0, time.UTC)}},
+			flushed: &record{"x", 51, now},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &tailAssembler{timeLayout: tt.layout}
+			if tt.start != "" {
+				a.start = regexp.MustCompile(tt.start)
+			}
+			if tt.timeRe != "" {
+				a.timeRegexp = regexp.MustCompile(tt.timeRe)
+			}
+
+			var records []record
+			var end int64
+			for _, l := range tt.lines {
+				end += int64(len(l)) + 1
+				if r := a.add([]byte(l), end, now); r != nil {
+					records = append(records, record{string(r.value), r.end, r.time})
+				}
+			}
+			if len(records) != len(tt.records) {
+				t.Fatalf("expected %v, got %v", tt.records, records)
+			}
+			for i := range records {
+				if !records[i].equal(tt.records[i]) {
+					t.Fatalf("expected %v, got %v", tt.records, records)
+				}
+			}
+
+			r := a.flush(now.Add(time.Second), tt.flushWait)
+			switch {
+			case r == nil && tt.flushed != nil:
+				t.Fatalf("expected %v flushed", *tt.flushed)
+			case r != nil && tt.flushed == nil:
+				t.Fatalf("unexpected flushed %q", r.value)
+			case r != nil && !tt.flushed.equal(record{string(r.value), r.end, r.time}):
+				t.Fatalf("expected %v flushed, got %q %d %v", *tt.flushed, r.value, r.end, r.time)
+			}
+			if (a.pending != nil) != tt.pending {
+				t.Fatalf("expected pending %v, got %v", tt.pending, a.pending)
+			}
+		})
+	}
+}
+
+func TestTailFileReadLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeTail(t, path, "")
+	f, err := openTailFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	type line struct {
+		value string
+		end   int64
+	}
+	steps := []struct {
+		name  string
+		write string
+		lines []line
+	}{
+		{"complete", "one\ntwo\n", []line{{"one", 4}, {"two", 8}}},
+		{"partial", "thr", nil},
+		{"partial continued", "ee\nfo", []line{{"three", 14}}},
+		{"crlf", "ur\r\n\r\n", []line{{"four", 20}, {"", 22}}},
+		{"nothing new", "", nil},
+	}
+	for _, s := range steps {
+		t.Run(s.name, func(t *testing.T) {
+			appendTail(t, path, s.write)
+
+			var lines []line
+			if err := f.readLines(func(l []byte, end int64) {
+				lines = append(lines, line{string(l), end})
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(lines, s.lines) {
+				t.Fatalf("expected %v, got %v", s.lines, lines)
+			}
+		})
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		appendTail(t, path, "last")
+
+		var lines []line
+		if err := f.drain(func(l []byte, end int64) {
+			lines = append(lines, line{string(l), end})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if expected := []line{{"last", 26}}; !reflect.DeepEqual(lines, expected) {
+			t.Fatalf("expected %v, got %v", expected, lines)
+		}
+	})
+}
+
+func TestTailFileMatchesRotated(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	writeTail(t, path, "one\ntwo\n")
+
+	f, err := openTailFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := f.state(4)
+	f.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated, then written to before the new file was created
+	appendTail(t, path, "three\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeTail(t, path, "four\n")
+
+	tests := []struct {
+		name    string
+		path    string
+		matches bool
+	}{
+		{"rotated", path + ".1", true},
+		{"new", path, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := openTailFile(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.close()
+			if m := f.matches(&st); m != tt.matches {
+				t.Fatalf("expected matches %v, got %v", tt.matches, m)
+			}
+		})
+	}
+}
+
+func writeTail(t *testing.T, path string, s string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendTail(t *testing.T, path string, s string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
 
 	"github.com/klev-dev/klev-api-go"
 	"github.com/spf13/cobra"
@@ -18,6 +22,9 @@ func tokensRoot() *cobra.Command {
 	cmd.AddCommand(tokensGet())
 	cmd.AddCommand(tokensUpdate())
 	cmd.AddCommand(tokensDelete())
+	cmd.AddCommand(tokensRotate())
+	cmd.AddCommand(tokensExplain())
+	cmd.AddCommand(tokensACLRoot())
 
 	return cmd
 }
@@ -54,16 +61,29 @@ func tokensCreate() *cobra.Command {
 	var in klev.TokenCreateParams
 
 	cmd.Flags().StringVar(&in.Metadata, "metadata", "", "machine readable metadata")
-	acl := cmd.Flags().StringArray("acl", nil, "token acl")
+	acl := cmd.Flags().StringArray("acl", nil, "token acl, as json")
+	allow := cmd.Flags().StringArray("allow", nil, "token acl, as 'subject:action:object'")
+	role := cmd.Flags().String("role", "", "token acl preset: producer, consumer or webhook-admin")
+	logID := cmd.Flags().String("log-id", "", "log id for producer and consumer roles")
+	offsetID := cmd.Flags().String("offset-id", "", "offset id for consumer role")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
-		for _, l := range *acl {
-			var item klev.ACLItem
-			if err := json.Unmarshal([]byte(l), &item); err != nil {
+		items, err := parseACL(*acl, *allow)
+		if err != nil {
+			return outputErr(err)
+		}
+		in.ACL = items
+
+		if cmd.Flags().Changed("role") {
+			items, err := aclRole(*role, *logID, *offsetID)
+			if err != nil {
 				return outputErr(err)
 			}
-			in.ACL = append(in.ACL, item)
+			in.ACL = append(in.ACL, items...)
+		} else if cmd.Flags().Changed("log-id") || cmd.Flags().Changed("offset-id") {
+			return fmt.Errorf("log-id and offset-id require role")
 		}
+
 		out, bearer, err := klient.Tokens.Create(cmd.Context(), in)
 		out.Bearer = bearer
 		return output(out, err)
@@ -73,20 +93,40 @@ func tokensCreate() *cobra.Command {
 }
 
 func tokensGet() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "get <token-id>",
 		Short: "get a token",
 		Args:  cobra.ExactArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
-			id, err := klev.ParseTokenID(args[0])
-			if err != nil {
-				return outputErr(err)
-			}
+	}
+
+	describe := cmd.Flags().Bool("describe-acl", false, "describe the token acl in plain words")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseTokenID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
 
-			out, err := klient.Tokens.Get(cmd.Context(), id)
+		out, err := klient.Tokens.Get(cmd.Context(), id)
+		if err != nil || !*describe {
 			return output(out, err)
-		},
+		}
+
+		return outputValue(TokenDescribeOut{
+			TokenID:  out.TokenID,
+			Metadata: out.Metadata,
+			ACL:      describeACL(out.ACL),
+		})
 	}
+
+	return cmd
+}
+
+// TokenDescribeOut is a token with its acl described in plain words
+type TokenDescribeOut struct {
+	TokenID  klev.TokenID `json:"token_id"`
+	Metadata string       `json:"metadata"`
+	ACL      []ACLItemOut `json:"acl"`
 }
 
 func tokensUpdate() *cobra.Command {
@@ -97,7 +137,8 @@ func tokensUpdate() *cobra.Command {
 	}
 
 	metadata := cmd.Flags().String("metadata", "", "machine readable metadata")
-	acl := cmd.Flags().StringArray("acl", nil, "token acl")
+	acl := cmd.Flags().StringArray("acl", nil, "token acl, as json")
+	allow := cmd.Flags().StringArray("allow", nil, "token acl, as 'subject:action:object'")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
 		id, err := klev.ParseTokenID(args[0])
@@ -110,14 +151,10 @@ func tokensUpdate() *cobra.Command {
 		if cmd.Flags().Changed("metadata") {
 			in.Metadata = metadata
 		}
-		if cmd.Flags().Changed("acl") {
-			var items []klev.ACLItem
-			for _, l := range *acl {
-				var item klev.ACLItem
-				if err := json.Unmarshal([]byte(l), &item); err != nil {
-					return outputErr(err)
-				}
-				items = append(items, item)
+		if cmd.Flags().Changed("acl") || cmd.Flags().Changed("allow") {
+			items, err := parseACL(*acl, *allow)
+			if err != nil {
+				return outputErr(err)
 			}
 			in.ACL = &items
 		}
@@ -145,3 +182,179 @@ func tokensDelete() *cobra.Command {
 		},
 	}
 }
+
+func tokensRotate() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rotate <token-id>",
+		Short: "replace a token with a new one, with the same metadata and acl",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	outputFile := cmd.Flags().String("output-file", "", "file to write the new bearer to")
+	grace := cmd.Flags().Duration("grace", 0, "how long to wait before deleting the old token, prompts when not set")
+	keep := cmd.Flags().Bool("keep-old", false, "do not delete the old token")
+
+	cmd.MarkFlagsMutuallyExclusive("grace", "keep-old")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseTokenID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		old, err := klient.Tokens.Get(cmd.Context(), id)
+		if err != nil {
+			return outputErr(err)
+		}
+
+		out, bearer, err := klient.Tokens.Create(cmd.Context(), klev.TokenCreateParams{
+			Metadata: old.Metadata,
+			ACL:      old.ACL,
+		})
+		if err != nil {
+			return outputErr(err)
+		}
+
+		// the bearer of the new token is only known here, delete it when it can't be used
+		discard := func(err error) error {
+			if _, delErr := klient.Tokens.Delete(context.Background(), out.TokenID); delErr != nil {
+				return outputErr(fmt.Errorf("%w (and new token %s could not be deleted: %v)", err, out.TokenID, delErr))
+			}
+			return outputErr(err)
+		}
+
+		// verify the new token is usable, before doing anything with the old one
+		if _, err := newKlient(bearer).Paths.Get(cmd.Context()); err != nil {
+			return discard(fmt.Errorf("could not verify new token %s: %w", out.TokenID, err))
+		}
+
+		if *outputFile != "" {
+			if err := os.WriteFile(*outputFile, []byte(bearer+"\n"), 0600); err != nil {
+				return discard(err)
+			}
+		} else {
+			out.Bearer = bearer
+		}
+
+		// printed before waiting, so the new token can be deployed
+		if err := outputValue(TokensRotateOut{Token: out, OldTokenID: old.TokenID}); err != nil {
+			return err
+		}
+
+		switch {
+		case *keep:
+			return nil
+		case cmd.Flags().Changed("grace"):
+			fmt.Fprintf(os.Stderr, "deleting old token %s in %s\n", old.TokenID, *grace)
+
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer cancel()
+
+			select {
+			case <-time.After(*grace):
+			case <-ctx.Done():
+				return fmt.Errorf("interrupted, old token %s was not deleted", old.TokenID)
+			}
+		default:
+			ok, err := confirm(fmt.Sprintf("delete old token %s now?", old.TokenID))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+		}
+
+		if _, err := klient.Tokens.Delete(cmd.Context(), old.TokenID); err != nil {
+			return outputErr(err)
+		}
+		fmt.Fprintf(os.Stderr, "deleted old token %s\n", old.TokenID)
+		return nil
+	}
+
+	return cmd
+}
+
+// TokensRotateOut is the new token, with the bearer unless written to a file
+type TokensRotateOut struct {
+	klev.Token
+	OldTokenID klev.TokenID `json:"old_token_id"`
+}
+
+func tokensExplain() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "explain <token-id>",
+		Short: "explain which commands a token can run",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	all := cmd.Flags().Bool("all", false, "also list commands the token cannot run")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		id, err := klev.ParseTokenID(args[0])
+		if err != nil {
+			return outputErr(err)
+		}
+
+		token, err := klient.Tokens.Get(cmd.Context(), id)
+		if err != nil {
+			return outputErr(err)
+		}
+
+		var commands []ACLCommandOut
+		for _, c := range explainACL(token.ACL) {
+			if *all || c.Access != aclAccessNone {
+				commands = append(commands, c)
+			}
+		}
+
+		return outputValue(TokenExplainOut{
+			TokenID:  token.TokenID,
+			Metadata: token.Metadata,
+			Commands: commands,
+		})
+	}
+
+	return cmd
+}
+
+// TokenExplainOut lists the commands a token can run
+type TokenExplainOut struct {
+	TokenID  klev.TokenID    `json:"token_id"`
+	Metadata string          `json:"metadata"`
+	Commands []ACLCommandOut `json:"commands"`
+}
+
+func tokensACLRoot() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "acl",
+		Short: "work with token acls locally",
+		// acl commands don't talk to klev, so they don't require authtoken
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+	}
+
+	cmd.AddCommand(tokensACLValidate())
+
+	return cmd
+}
+
+func tokensACLValidate() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "validate [subject:action:object...]",
+		Short: "validate acl items against known subjects, actions and objects",
+	}
+
+	acl := cmd.Flags().StringArray("acl", nil, "token acl, as json")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		items, err := parseACL(*acl, args)
+		if err != nil {
+			return outputErr(err)
+		}
+		return outputValue(describeACL(items))
+	}
+
+	return cmd
+}
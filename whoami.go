@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/klev-dev/klev-api-go"
+)
+
+// WhoamiOut describes the token used by the cli
+type WhoamiOut struct {
+	Source   string          `json:"source"`
+	Bearer   string          `json:"bearer"`
+	TokenID  *klev.TokenID   `json:"token_id,omitempty"`
+	Metadata string          `json:"metadata,omitempty"`
+	ACL      []ACLItemOut    `json:"acl,omitempty"`
+	Error    *klev.APIError  `json:"error,omitempty"`
+	Commands []ACLCommandOut `json:"commands"`
+}
+
+func whoami() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "whoami",
+		Short: "describe the active token and which commands it can run",
+		Args:  cobra.NoArgs,
+	}
+
+	tokenID := cmd.Flags().String("token-id", "", "id of the active token, when it can't be found by its bearer in the token list")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if _, err := klient.Paths.Get(cmd.Context()); err != nil {
+			return outputErr(err)
+		}
+
+		out := WhoamiOut{
+			Source: authSource,
+			Bearer: maskBearer(auth),
+		}
+
+		var id klev.TokenID
+		var err error
+		if cmd.Flags().Changed("token-id") {
+			id, err = klev.ParseTokenID(*tokenID)
+		} else {
+			id, err = findTokenID(cmd.Context(), auth)
+		}
+		if err != nil {
+			if out.Error = klev.GetError(err); out.Error == nil {
+				out.Error = &klev.APIError{Message: err.Error()}
+			}
+			out.Commands = probeACL(cmd.Context())
+			return outputValue(out)
+		}
+
+		token, err := klient.Tokens.Get(cmd.Context(), id)
+		if err != nil {
+			if out.Error = klev.GetError(err); out.Error == nil {
+				return outputErr(err)
+			}
+			out.TokenID = &id
+			out.Commands = probeACL(cmd.Context())
+			return outputValue(out)
+		}
+
+		out.TokenID = &token.TokenID
+		out.Metadata = token.Metadata
+		out.ACL = describeACL(token.ACL)
+		out.Commands = explainACL(token.ACL)
+		return outputValue(out)
+	}
+
+	return cmd
+}
+
+var errTokenIDNotFound = errors.New("the token is not found by its bearer in the token list. pass '--token-id'")
+
+// findTokenID looks up the active token in the token list, matching its bearer
+func findTokenID(ctx context.Context, bearer string) (klev.TokenID, error) {
+	tokens, err := klient.Tokens.List(ctx)
+	if err != nil {
+		return klev.TokenID{}, fmt.Errorf("could not list tokens (%v). pass '--token-id'", err)
+	}
+	for _, t := range tokens {
+		if t.Bearer != "" && t.Bearer == bearer {
+			return t.TokenID, nil
+		}
+	}
+	return klev.TokenID{}, errTokenIDNotFound
+}
+
+func maskBearer(bearer string) string {
+	if len(bearer) <= 8 {
+		return "****"
+	}
+	return bearer[:4] + "****" + bearer[len(bearer)-4:]
+}
+
+// probeACL is used when the token acl is not available. It tries each
+// of the list commands, while the rest of the commands are reported as unknown
+func probeACL(ctx context.Context) []ACLCommandOut {
+	probes := map[klev.Subject]func(context.Context) error{
+		klev.SubjectLogs: func(ctx context.Context) error {
+			_, err := klient.Logs.List(ctx)
+			return err
+		},
+		klev.SubjectOffsets: func(ctx context.Context) error {
+			_, err := klient.Offsets.List(ctx)
+			return err
+		},
+		klev.SubjectTokens: func(ctx context.Context) error {
+			_, err := klient.Tokens.List(ctx)
+			return err
+		},
+		klev.SubjectIngressWebhooks: func(ctx context.Context) error {
+			_, err := klient.IngressWebhooks.List(ctx)
+			return err
+		},
+		klev.SubjectEgressWebhooks: func(ctx context.Context) error {
+			_, err := klient.EgressWebhooks.List(ctx)
+			return err
+		},
+		klev.SubjectFilters: func(ctx context.Context) error {
+			_, err := klient.Filters.List(ctx)
+			return err
+		},
+	}
+
+	var out = make([]ACLCommandOut, len(aclCommands))
+	for i, c := range aclCommands {
+		probe, ok := probes[c.subject]
+		switch {
+		case c.subject == klev.NilSubject:
+			out[i] = explainACLCommand(c, nil)
+		case ok && c.action == klev.ActionList:
+			if err := probe(ctx); err != nil {
+				out[i] = explainACLCommand(c, nil)
+			} else {
+				out[i] = explainACLCommand(c, []klev.ACLItem{klev.ACLAction(c.subject, c.action)})
+			}
+		default:
+			out[i] = ACLCommandOut{
+				Command:     c.command,
+				Access:      aclAccessUnknown,
+				Description: "unknown, token acl is not available",
+			}
+		}
+	}
+	return out
+}